@@ -1,26 +1,51 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"sina.http/internal/request"
+	"sina.http/internal/response"
 	"sina.http/internal/server"
 )
 
 const port = 42069
+const shutdownTimeout = 5 * time.Second
+
+func handler(w *response.Writer, req *request.Request) {
+	body := []byte("Hello World\r\n")
+	w.WriteStatusLine(response.StatusCodeOk)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
 
 func main() {
-	server, err := server.Serve(port)
+	srv := server.New(handler)
+	srv.Use(server.LogRequests)
+	srv.ReadHeaderTimeout = 10 * time.Second
+	srv.ReadTimeout = time.Minute
+	srv.WriteTimeout = time.Minute
+	srv.IdleTimeout = 2 * time.Minute
+	err := srv.Listen(port)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer server.Close()
 	log.Println("Server started on port", port)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM) // relays SIGINT (ctrl C)+SIGNTERM (used by system tools like PKILL)signals to the channel
 	<-sigChan                                               // blocks and waits for a signal to arrive to the channel (will if ctrl C or kill input by terminal b/c line above)
+
+	// give in-flight requests a few seconds to finish before cutting them off
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Server shutdown didn't finish cleanly: %v", err)
+		return
+	}
 	log.Println("Server gracefully stopped")
 }
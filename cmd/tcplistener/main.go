@@ -26,6 +26,9 @@ func main() {
 		log.Fatal("error", err)
 	}
 	r, err := request.RequestFromReader(conn)
+	if err != nil {
+		log.Fatal("error", err)
+	}
 	r.Print()
 }
 
@@ -3,30 +3,150 @@ package headers
 import (
 	"bytes"
 	"fmt"
+	"iter"
+	"slices"
 	"strings"
 )
 
-var BAD_HEADER = fmt.Errorf("Malformed HTTP header")
+// HeaderError is a problem with the headers a client sent, Status is the response code the server should reply with
+type HeaderError struct {
+	Status int
+	Msg    string
+}
+
+func (e *HeaderError) Error() string {
+	return e.Msg
+}
+
+func (e *HeaderError) StatusCode() int {
+	return e.Status
+}
+
+var BAD_HEADER = &HeaderError{Status: 400, Msg: "Malformed HTTP header"}
 var crlf = []byte("\r\n")
 
-type Headers map[string]string
+// Field is a single header line, Name keeps whatever casing it was added with
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Headers keeps every field in the order it was added so repeated fields (ex. Set-Cookie) stay separate lines
+// lookups ignore case but the original spelling of each name is kept for writing them back out
+type Headers struct {
+	fields []Field
+}
+
+func NewHeaders() *Headers {
+	return &Headers{}
+}
+
+// Get returns every value for name joined with ", ", which is how repeated list fields combine
+// use Values for fields like Set-Cookie that can't be combined
+func (h *Headers) Get(name string) string {
+	return strings.Join(h.Values(name), ", ")
+}
+
+// Values returns each value for name in the order they were added
+func (h *Headers) Values(name string) []string {
+	var vals []string
+	for _, f := range h.fields {
+		if strings.EqualFold(f.Name, name) {
+			vals = append(vals, f.Value)
+		}
+	}
+	return vals
+}
 
-// use getter for case-insensitive field names
-func (h Headers) Get(name string) string {
-	return h[strings.ToLower(name)]
+// Has reports whether there's at least one field called name
+func (h *Headers) Has(name string) bool {
+	return slices.ContainsFunc(h.fields, func(f Field) bool {
+		return strings.EqualFold(f.Name, name)
+	})
 }
 
-func (h Headers) Set(name, val string) {
-	name = strings.ToLower(name)
-	if contains, ok := h[name]; ok {
-		h[name] = contains + ", " + val
-	} else {
-		h[name] = val
+// Add appends another field, keeping any existing ones with the same name
+func (h *Headers) Add(name, val string) {
+	h.fields = append(h.fields, Field{Name: name, Value: val})
+}
+
+// Set replaces every field called name with a single one, which takes the place of the first existing one
+func (h *Headers) Set(name, val string) {
+	idx := slices.IndexFunc(h.fields, func(f Field) bool {
+		return strings.EqualFold(f.Name, name)
+	})
+	if idx == -1 {
+		h.Add(name, val)
+		return
 	}
+	h.fields[idx] = Field{Name: name, Value: val}
+	// drop any other fields with the same name after it, filtering in place is safe since out never gets ahead of the loop
+	out := h.fields[:idx+1]
+	for _, f := range h.fields[idx+1:] {
+		if !strings.EqualFold(f.Name, name) {
+			out = append(out, f)
+		}
+	}
+	h.fields = out
 }
 
-// Determines if a string is a valid token (i.e. letter, digit or allowed special char)
-func isToken(str string) bool {
+func (h *Headers) Del(name string) {
+	h.fields = slices.DeleteFunc(h.fields, func(f Field) bool {
+		return strings.EqualFold(f.Name, name)
+	})
+}
+
+// Len is the number of field lines, repeated names count once per line
+func (h *Headers) Len() int {
+	return len(h.fields)
+}
+
+// All iterates over every field in order with its original name spelling
+func (h *Headers) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		for _, f := range h.fields {
+			if !yield(f.Name, f.Value) {
+				return
+			}
+		}
+	}
+}
+
+func (h *Headers) Clone() *Headers {
+	return &Headers{fields: slices.Clone(h.fields)}
+}
+
+// HasToken reports whether the comma separated list in header name contains token (case-insensitive)
+// ex. HasToken("Connection", "close") for "Connection: keep-alive, Close"
+func (h *Headers) HasToken(name, token string) bool {
+	for _, part := range strings.Split(h.Get(name), ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
+var BAD_HEADER_NAME = &HeaderError{Status: 500, Msg: "header field name isn't a valid token"}
+var BAD_HEADER_VALUE = &HeaderError{Status: 500, Msg: "header field value contains CR, LF or NUL"}
+
+// Validate checks every field is safe to write out, a CR or LF in a value would let it start a new header line
+// or end the headers early (response splitting) so those get rejected along with NUL and names that aren't tokens
+func (h *Headers) Validate() error {
+	for _, f := range h.fields {
+		if f.Name == "" || !IsToken(f.Name) {
+			return fmt.Errorf("%w: %q", BAD_HEADER_NAME, f.Name)
+		}
+		if strings.ContainsAny(f.Value, "\r\n\x00") {
+			return fmt.Errorf("%w: %s: %q", BAD_HEADER_VALUE, f.Name, f.Value)
+		}
+	}
+	return nil
+}
+
+// IsToken determines if a string is a valid token (i.e. letter, digit or allowed special char)
+// an empty string counts as one so callers that need a non-empty token have to check that too
+func IsToken(str string) bool {
 	allowedSpecialChars := "!#$%&'*+-.^_`|~"
 	for _, rune := range str {
 		switch {
@@ -47,8 +167,8 @@ func isToken(str string) bool {
 
 // Will take in the data and only parse one header at a time
 // Returns number of bytes parsed, done == parsed all headers, error
-// can pass in Headers by value as maps are reference types so h is copy of ptr to hashmap
-func (h Headers) Parse(data []byte) (int, bool, error) {
+// repeated field names are kept as separate fields in the order they came in
+func (h *Headers) Parse(data []byte) (int, bool, error) {
 	crlfIdx := bytes.Index(data, crlf)
 	if crlfIdx == -1 {
 		return 0, false, nil
@@ -60,16 +180,12 @@ func (h Headers) Parse(data []byte) (int, bool, error) {
 	hdr := string(data[:crlfIdx])
 	trimmed := strings.TrimSpace(hdr) // trim whitespace before and after field name & field val
 	fn, fv, ok := strings.Cut(trimmed, ":")
-	if !ok || strings.Contains(fn, " ") || !isToken(fn) {
+	if !ok || strings.Contains(fn, " ") || !IsToken(fn) {
 		return 0, false, BAD_HEADER
 	}
-	// trim optional whitespace before and after field val before adding it to headers map
+	// trim optional whitespace before and after field val before adding it to headers
 	fv = strings.TrimSpace(fv)
-	h.Set(fn, fv)
+	h.Add(fn, fv)
 
 	return parsedN, false, nil
 }
-
-func NewHeaders() Headers {
-	return make(Headers)
-}
@@ -75,3 +75,70 @@ func TestHeaderParsing(t *testing.T) {
 	assert.False(t, done)
 
 }
+
+func TestMultiValueHeaders(t *testing.T) {
+	h := NewHeaders()
+	h.Add("Content-Type", "text/html")
+	h.Add("Set-Cookie", "a=1; Path=/")
+	h.Add("X-Trace", "abc")
+	h.Add("set-cookie", "b=2, with a comma")
+
+	// Test: repeated fields stay separate and in order
+	assert.Equal(t, []string{"a=1; Path=/", "b=2, with a comma"}, h.Values("SET-COOKIE"))
+	assert.Equal(t, 4, h.Len())
+
+	// Test: original spelling and insertion order are kept for iteration
+	var names []string
+	for name := range h.All() {
+		names = append(names, name)
+	}
+	assert.Equal(t, []string{"Content-Type", "Set-Cookie", "X-Trace", "set-cookie"}, names)
+
+	// Test: Set replaces every existing value in place of the first one
+	h.Set("SET-COOKIE", "c=3")
+	assert.Equal(t, []string{"c=3"}, h.Values("set-cookie"))
+	names = nil
+	for name := range h.All() {
+		names = append(names, name)
+	}
+	assert.Equal(t, []string{"Content-Type", "SET-COOKIE", "X-Trace"}, names)
+
+	// Test: Set on a new name appends it
+	h.Set("Cache-Control", "no-store")
+	assert.Equal(t, "no-store", h.Get("cache-control"))
+
+	// Test: Del removes every field with that name
+	h.Del("content-type")
+	assert.False(t, h.Has("Content-Type"))
+	assert.Equal(t, "", h.Get("Content-Type"))
+	assert.Nil(t, h.Values("Content-Type"))
+	assert.Equal(t, 3, h.Len())
+
+	// Test: Clone doesn't share fields with the original
+	c := h.Clone()
+	c.Add("X-Trace", "def")
+	assert.Equal(t, []string{"abc"}, h.Values("x-trace"))
+	assert.Equal(t, []string{"abc", "def"}, c.Values("x-trace"))
+}
+
+func TestValidate(t *testing.T) {
+	// Test: ordinary fields are fine
+	h := NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	h.Add("Set-Cookie", "a=1; Path=/")
+	assert.NoError(t, h.Validate())
+
+	// Test: CR, LF or NUL in a value would let it inject extra header lines
+	for _, v := range []string{"a\r\nSet-Cookie: evil=1", "a\nb", "a\rb", "a\x00b"} {
+		h = NewHeaders()
+		h.Set("X-Test", v)
+		assert.ErrorIs(t, h.Validate(), BAD_HEADER_VALUE)
+	}
+
+	// Test: names have to be non-empty tokens
+	for _, n := range []string{"", "Bad Name", "Bad:Name", "Bad\r\nName"} {
+		h = NewHeaders()
+		h.Set(n, "v")
+		assert.ErrorIs(t, h.Validate(), BAD_HEADER_NAME)
+	}
+}
@@ -0,0 +1,293 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"sina.http/internal/headers"
+)
+
+var BODY_NOT_DRAINED = fmt.Errorf("previous request body wasn't fully read so the connection can't be reused")
+var BODY_CLOSED = fmt.Errorf("read on closed request body")
+var CONFLICTING_FRAMING = &ParseError{Status: 400, Msg: "request has both Transfer-Encoding and Content-Length"}
+var BAD_TRANSFER_ENCODING = &ParseError{Status: 400, Msg: "invalid transfer-encoding"}
+var UNSUPPORTED_TRANSFER_CODING = &ParseError{Status: 501, Msg: "unsupported transfer coding"}
+
+// body states, which one we start in depends on how the body is framed
+const (
+	lengthState    = "length"     // Content-Length bytes of body
+	chunkSizeState = "chunk-size" // chunk-size [ chunk-ext ] CRLF
+	chunkDataState = "chunk-data" // chunk-data, may arrive over several reads
+	chunkEndState  = "chunk-end"  // CRLF after the chunk-data
+	trailerState   = "trailers"   // trailer fields after the last chunk, parsed like headers
+	bodyDoneState  = "body-done"
+)
+
+// Close throws away at most this much unread body to keep the connection usable, anything bigger isn't worth waiting on
+const maxDrain = 256 << 10
+
+// body is what ends up in Request.Body, it decodes the body straight out of the Reader's buffer as the handler reads
+type body struct {
+	rr        *Reader
+	req       *Request
+	state     string
+	remaining uint64 // bytes left in the whole body (length) or the current chunk (chunked)
+	total     uint64 // bytes of a chunked body so far, checked against the body size limit as we go
+	err       error  // sticky, once the body is broken every Read returns it
+	statusErr error  // err if it's something wrong with what the client sent, see Request.BodyError
+	closed    bool
+}
+
+// figures out how the body is framed from the headers following RFC 9112 section 6.3, no Content-Length or Transfer-Encoding means no body
+// anything ambiguous gets rejected instead of guessed at, if we and a proxy in front of us disagreed on where the body ends
+// the leftover bytes would get read as a second request (request smuggling)
+func newBody(rr *Reader, req *Request) (*body, error) {
+	b := &body{rr: rr, req: req, state: bodyDoneState}
+	if req.Headers.Has("transfer-encoding") {
+		if req.Headers.Has("content-length") {
+			return nil, CONFLICTING_FRAMING
+		}
+		if err := checkTransferEncoding(req); err != nil {
+			return nil, err
+		}
+		// no way to know the size up front, gets checked chunk by chunk instead
+		b.state = chunkSizeState
+		return b, nil
+	}
+	if !req.Headers.Has("content-length") {
+		return b, nil
+	}
+	conLen, err := parseContentLength(req.Headers.Values("content-length"))
+	if err != nil {
+		return nil, err
+	}
+	if rr.limits.bodyTooLarge(conLen) {
+		return nil, BODY_TOO_LARGE
+	}
+	if conLen > 0 {
+		b.state = lengthState
+		b.remaining = conLen
+	}
+	return b, nil
+}
+
+// chunked has to be there and come last, otherwise there's no telling where the body ends
+// we don't decode any other codings (ex. gzip) so those are a 501
+func checkTransferEncoding(req *Request) error {
+	if req.RequestLine.HttpVersion == "1.0" {
+		// 1.0 doesn't have Transfer-Encoding so whatever sent this can't be trusted to agree with us on the framing
+		return fmt.Errorf("%w: Transfer-Encoding in an HTTP/1.0 request", BAD_TRANSFER_ENCODING)
+	}
+	var codings []string
+	for _, v := range req.Headers.Values("transfer-encoding") {
+		for _, coding := range strings.Split(v, ",") {
+			codings = append(codings, strings.ToLower(strings.TrimSpace(coding)))
+		}
+	}
+	for i, coding := range codings {
+		switch {
+		case coding == "chunked" && i != len(codings)-1:
+			return fmt.Errorf("%w: chunked has to be the final coding, got %q", BAD_TRANSFER_ENCODING, req.Headers.Get("transfer-encoding"))
+		case coding == "chunked":
+			continue
+		case coding == "" || i == len(codings)-1:
+			return fmt.Errorf("%w: %q", BAD_TRANSFER_ENCODING, req.Headers.Get("transfer-encoding"))
+		default:
+			return fmt.Errorf("%w: %q", UNSUPPORTED_TRANSFER_CODING, coding)
+		}
+	}
+	return nil
+}
+
+// every Content-Length field (and every item of a comma separated one) has to be the same run of digits
+// repeats of the same value are allowed since some proxies duplicate the header, different values aren't
+func parseContentLength(values []string) (uint64, error) {
+	conLen := uint64(0)
+	seen := false
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" || strings.TrimLeft(item, "0123456789") != "" {
+				// also catches signs (-1, +5), which strconv would otherwise accept
+				return 0, fmt.Errorf("%w: %q", BAD_CONTENT_LENGTH, v)
+			}
+			n, err := strconv.ParseUint(item, 10, 63)
+			if err != nil {
+				return 0, fmt.Errorf("%w: %q: %w", BAD_CONTENT_LENGTH, v, err)
+			}
+			if seen && n != conLen {
+				return 0, fmt.Errorf("%w: conflicting values %q", BAD_CONTENT_LENGTH, strings.Join(values, ", "))
+			}
+			conLen, seen = n, true
+		}
+	}
+	return conLen, nil
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, BODY_CLOSED
+	}
+	return b.read(p)
+}
+
+// lets Close drain through read without tripping the closed check in Read
+type drainReader struct {
+	b *body
+}
+
+func (d drainReader) Read(p []byte) (int, error) {
+	return d.b.read(p)
+}
+
+func (b *body) read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for b.state != bodyDoneState {
+		prevState := b.state
+		consumed, produced, err := b.onePass(b.rr.buf[:b.rr.bufLen], p)
+		b.rr.discard(consumed)
+		if err != nil {
+			b.err = err
+			var pe *ParseError
+			var he *headers.HeaderError
+			if errors.As(err, &pe) || errors.As(err, &he) {
+				b.statusErr = err
+			}
+			return produced, err
+		}
+		if produced > 0 {
+			return produced, nil
+		}
+		// moving past a chunk-size line or CRLF is progress even though the handler got no bytes yet
+		if consumed > 0 || b.state != prevState {
+			continue
+		}
+		if err := b.rr.readMore(b.state); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF // connection ended before the body did
+			}
+			b.err = errors.Join(fmt.Errorf("reader.Read() error while reading request body"), err)
+			return 0, b.err
+		}
+	}
+	return 0, io.EOF
+}
+
+// Close reads and throws away whatever the handler left unread so the next request on the connection can be parsed
+// returns an error if the rest of the body was broken or too big to bother with, in which case the connection has to go
+func (b *body) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	if b.state == bodyDoneState {
+		return nil
+	}
+	_, err := io.CopyN(io.Discard, drainReader{b}, maxDrain)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if b.state != bodyDoneState {
+		return BODY_NOT_DRAINED
+	}
+	return nil
+}
+
+// decodes as much of data into p as it can
+// consumed is how much of data was used up, produced is how many body bytes went into p
+func (b *body) onePass(data, p []byte) (consumed int, produced int, err error) {
+	switch b.state {
+	case lengthState:
+		n := int(min(uint64(len(data)), uint64(len(p)), b.remaining))
+		copy(p, data[:n])
+		b.remaining -= uint64(n)
+		if b.remaining == 0 {
+			b.state = bodyDoneState
+		}
+		return n, n, nil
+	case chunkSizeState:
+		idx := bytes.Index(data, CRLF)
+		if idx == -1 {
+			return 0, 0, nil
+		}
+		size, err := parseChunkSize(data[:idx])
+		if err != nil {
+			return 0, 0, errors.Join(fmt.Errorf("unable to parse chunk size line: %q", data[:idx]), err)
+		}
+		b.total += size
+		if size > uint64(math.MaxInt64) || b.rr.limits.bodyTooLarge(b.total) {
+			return 0, 0, BODY_TOO_LARGE
+		}
+		b.remaining = size
+		b.state = chunkDataState
+		if size == 0 {
+			b.state = trailerState // last chunk, only trailers left
+		}
+		return idx + len(CRLF), 0, nil
+	case chunkDataState:
+		// hand over whatever part of the chunk has arrived so big chunks don't have to fit in the buffer all at once
+		n := int(min(uint64(len(data)), uint64(len(p)), b.remaining))
+		copy(p, data[:n])
+		b.remaining -= uint64(n)
+		if b.remaining == 0 {
+			b.state = chunkEndState
+		}
+		return n, n, nil
+	case chunkEndState:
+		if len(data) < len(CRLF) {
+			return 0, 0, nil
+		}
+		if !bytes.HasPrefix(data, CRLF) {
+			return 0, 0, BAD_CHUNK
+		}
+		b.state = chunkSizeState
+		return len(CRLF), 0, nil
+	case trailerState:
+		if err := checkFieldLine(data); err != nil {
+			return 0, 0, err
+		}
+		n, done, err := b.req.Trailers.Parse(data)
+		if err != nil {
+			return n, 0, errors.Join(fmt.Errorf("unable to parse trailers data passed was: %q", data), err)
+		}
+		if done {
+			b.state = bodyDoneState
+			return n, 0, nil
+		}
+		// trailers count against the same limits as the headers
+		if n > 0 {
+			b.req.headerBytes += n
+			b.req.headerCount++
+		}
+		if b.req.headerBytes > b.rr.limits.MaxHeaderBytes || b.req.headerCount > b.rr.limits.MaxHeaderCount {
+			return 0, 0, HEADERS_TOO_LARGE
+		}
+		return n, 0, nil
+	}
+	return 0, 0, nil
+}
+
+// chunk-size = 1*HEXDIG, optionally followed by ;name=value extensions which we don't use so they get skipped
+func parseChunkSize(line []byte) (uint64, error) {
+	sizeStr, _, _ := strings.Cut(string(line), ";")
+	sizeStr = strings.TrimRight(sizeStr, " \t")
+	// ParseUint would let through a leading +, and anything longer than 16 hex digits can't be real
+	if sizeStr == "" || len(sizeStr) > 16 || strings.HasPrefix(sizeStr, "+") {
+		return 0, BAD_CHUNK
+	}
+	size, err := strconv.ParseUint(sizeStr, 16, 64)
+	if err != nil {
+		return 0, errors.Join(BAD_CHUNK, err)
+	}
+	return size, nil
+}
@@ -0,0 +1,49 @@
+package request
+
+// Limits caps how big the different parts of a request are allowed to get so a client can't make us buffer forever
+// zero fields fall back to DefaultLimits
+type Limits struct {
+	MaxURILength   int   // length of the request target, 414 URI Too Long if over
+	MaxHeaderBytes int   // total bytes of header (and trailer) field lines, 431 Request Header Fields Too Large if over
+	MaxHeaderCount int   // number of header (and trailer) field lines, 431 if over
+	MaxBodySize    int64 // body bytes, 413 Content Too Large if over. negative means no limit
+}
+
+// DefaultLimits is what zero Limits fields fall back to
+// bodies are read as a stream so by default they aren't capped, a handler that buffers them (BufferBody) should set MaxBodySize
+var DefaultLimits = Limits{
+	MaxURILength:   8 << 10,
+	MaxHeaderBytes: 1 << 20,
+	MaxHeaderCount: 100,
+	MaxBodySize:    -1,
+}
+
+// room for the method, version and spaces around the target on the request line
+const requestLineOverhead = 64
+
+// fills in zero fields from DefaultLimits
+func (l Limits) withDefaults() Limits {
+	if l.MaxURILength == 0 {
+		l.MaxURILength = DefaultLimits.MaxURILength
+	}
+	if l.MaxHeaderBytes == 0 {
+		l.MaxHeaderBytes = DefaultLimits.MaxHeaderBytes
+	}
+	if l.MaxHeaderCount == 0 {
+		l.MaxHeaderCount = DefaultLimits.MaxHeaderCount
+	}
+	if l.MaxBodySize == 0 {
+		l.MaxBodySize = DefaultLimits.MaxBodySize
+	}
+	return l
+}
+
+// the read buffer never has to hold more than a full request line or a full header section at once
+func (l Limits) maxBuffer() int {
+	return max(l.MaxURILength+requestLineOverhead, l.MaxHeaderBytes) + len(CRLF)
+}
+
+// reports whether n body bytes is over the limit
+func (l Limits) bodyTooLarge(n uint64) bool {
+	return l.MaxBodySize >= 0 && n > uint64(l.MaxBodySize)
+}
@@ -5,43 +5,174 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"strconv"
 	"strings"
 
 	"sina.http/internal/headers"
 )
 
-var BAD_REQ_LINE = fmt.Errorf("malformed request line")
-var UNSUPPORTED_HTTP_VERSION = fmt.Errorf("Unsupported http version")
+// ParseError is a problem with what the client sent, Status is the response code the server should reply with
+// the server finds it with errors.As on anything implementing StatusCode() so headers.HeaderError works the same way
+type ParseError struct {
+	Status int
+	Msg    string
+}
+
+func (e *ParseError) Error() string {
+	return e.Msg
+}
+
+func (e *ParseError) StatusCode() int {
+	return e.Status
+}
+
+var BAD_REQ_LINE = &ParseError{Status: 400, Msg: "malformed request line"}
+var UNSUPPORTED_HTTP_VERSION = &ParseError{Status: 505, Msg: "Unsupported http version"}
+var BAD_CONTENT_LENGTH = &ParseError{Status: 400, Msg: "invalid content-length"}
+var REQ_LINE_TOO_LONG = &ParseError{Status: 414, Msg: "request line too long"}
+var HEADERS_TOO_LARGE = &ParseError{Status: 431, Msg: "request header fields too large"}
+var BODY_TOO_LARGE = &ParseError{Status: 413, Msg: "request body too large"}
+var BAD_CHUNK = &ParseError{Status: 400, Msg: "malformed chunked body"}
+var BAD_FIELD_LINE = &ParseError{Status: 400, Msg: "header field line is folded or has CR, LF or NUL in it"}
+var MISSING_HOST = &ParseError{Status: 400, Msg: "HTTP/1.1 request without a Host header"}
+var BAD_HOST = &ParseError{Status: 400, Msg: "invalid Host header"}
+var EXPECTATION_FAILED = &ParseError{Status: 417, Msg: "unsupported expectation"}
 var CRLF = []byte("\r\n")
 
 // using string enum for better readability
 const (
 	initState   = "init"
 	headerState = "headers"
-	bodyState   = "body"
-	finalState  = "done"
+	bodyState   = "body" // request line + headers are done, the rest is up to Body (see body.go)
 )
 
 type Request struct {
 	RequestLine RequestLine
-	headers     headers.Headers
-	// In Go implementation body is a io.ReadCloser -> much more performant b/c can stream body instead of reading it all in at once
-	// Ideally handler would get reader of body and would read as necessary
-	Body  []byte
-	state string
+	// RequestLine.RequestTarget parsed into path, query etc.
+	URL     *URL
+	Headers *headers.Headers
+	// streams straight off the connection as the handler reads it so big uploads never have to sit in memory
+	// never nil, a request without a body gets one that's immediately at EOF. use BufferBody to get it all at once
+	Body io.ReadCloser
+	// trailer fields sent after a chunked body, kept apart from Headers since they arrive after the handler could have looked
+	// only filled in once Body has been read to EOF
+	Trailers *headers.Headers
+	// filled in (percent-decoded) by the router when the matched route pattern has {name} or *name segments
+	PathParams map[string]string
+	// the body as it came off the connection, kept even if Body gets wrapped or buffered so BodyError still works
+	body *body
+	// what BufferBody read, so Print can show the body without reading it off the connection
+	buffered []byte
+	state    string
+	limits   Limits
+	// running totals for the header section so we can stop at limits.MaxHeaderBytes/MaxHeaderCount
+	headerBytes int
+	headerCount int
+}
+
+// BufferBody reads the rest of the body into memory and swaps Body for an in-memory copy so it can still be read after
+func (r *Request) BufferBody() ([]byte, error) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return data, err
+	}
+	if err := r.Body.Close(); err != nil {
+		return data, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	r.buffered = data
+	return data, nil
+}
+
+// BodyError returns what went wrong reading the body if it was the client's fault (ex. BODY_TOO_LARGE or BAD_CHUNK)
+// it has a StatusCode like the parse errors from ReadRequest so the server can answer with it, nil if the body is fine so far
+func (r *Request) BodyError() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.statusErr
 }
 
-func (r Request) Print() {
+// PathParam returns the value captured for name by the router, or "" if there isn't one
+func (r *Request) PathParam(name string) string {
+	return r.PathParams[name]
+}
+
+// Host is the host the request is for, taken from an absolute-form target if there is one and the Host header otherwise
+// ex. example.com:8080
+func (r *Request) Host() string {
+	if r.URL != nil && r.URL.Host != "" {
+		return r.URL.Host
+	}
+	return r.Headers.Get("host")
+}
+
+// HTTP/1.1 requests need exactly one Host header, 1.0 ones can leave it out but still can't send more than one
+// it can be empty (no authority in the target) but otherwise has to look like host[:port]
+func (r *Request) checkHost() error {
+	hosts := r.Headers.Values("host")
+	switch {
+	case len(hosts) == 0 && r.RequestLine.HttpVersion == "1.0":
+		return nil
+	case len(hosts) == 0:
+		return MISSING_HOST
+	case len(hosts) > 1:
+		return fmt.Errorf("%w: %d Host headers", BAD_HOST, len(hosts))
+	case hosts[0] != "" && !isAuthority(hosts[0]):
+		return fmt.Errorf("%w: %q", BAD_HOST, hosts[0])
+	}
+	return nil
+}
+
+// ExpectsContinue reports whether the client sent Expect: 100-continue and is waiting to be told to send the body
+// HTTP/1.0 clients can't know about it so it's ignored for them
+func (r *Request) ExpectsContinue() bool {
+	return r.RequestLine.HttpVersion != "1.0" && r.Headers.HasToken("expect", "100-continue")
+}
+
+// 100-continue is the only expectation there is, anything else gets a 417
+func (r *Request) checkExpect() error {
+	for _, v := range r.Headers.Values("expect") {
+		for _, part := range strings.Split(v, ",") {
+			if !strings.EqualFold(strings.TrimSpace(part), "100-continue") {
+				return fmt.Errorf("%w: %q", EXPECTATION_FAILED, v)
+			}
+		}
+	}
+	return nil
+}
+
+// KeepAlive reports whether the client is fine with the connection staying open after this request
+// HTTP/1.1 connections are persistent unless the client sends Connection: close
+// HTTP/1.0 ones are closed after each response unless the client asks for Connection: keep-alive
+func (r *Request) KeepAlive() bool {
+	if r.Headers.HasToken("connection", "close") {
+		return false
+	}
+	if r.RequestLine.HttpVersion == "1.0" {
+		return r.Headers.HasToken("connection", "keep-alive")
+	}
+	return true
+}
+
+func (r *Request) Print() {
 	fmt.Println("Request line:")
 	fmt.Printf("- Method: %s\n", r.RequestLine.Method)
 	fmt.Printf("- Target: %s\n", r.RequestLine.RequestTarget)
 	fmt.Printf("- Version: %s\n", r.RequestLine.HttpVersion)
 	fmt.Println("Headers:")
-	for key, value := range r.headers {
+	for key, value := range r.Headers.All() {
 		fmt.Printf("- %s: %s\n", key, value)
 	}
-	fmt.Printf("Body:\n %s\n", string(r.Body))
+	// only a body that's already been buffered, reading it here would take it away from whoever handles the request
+	if r.buffered != nil {
+		fmt.Printf("Body:\n %s\n", string(r.buffered))
+	}
+	if r.Trailers.Len() > 0 {
+		fmt.Println("Trailers:")
+		for key, value := range r.Trailers.All() {
+			fmt.Printf("- %s: %s\n", key, value)
+		}
+	}
 	fmt.Println()
 }
 
@@ -57,38 +188,55 @@ func (r *Request) onePass(unparsed_data []byte) (int, error) {
 			return n, errors.Join(fmt.Errorf("unable to parse request line, data passed was: %q", unparsed_data), err)
 		}
 		if n == 0 {
+			// no CRLF yet, no point waiting for more if what we have is already over the limit
+			if len(unparsed_data) > r.limits.MaxURILength+requestLineOverhead {
+				return 0, REQ_LINE_TOO_LONG
+			}
 			break
 		}
+		if len(rl.RequestTarget) > r.limits.MaxURILength {
+			return 0, REQ_LINE_TOO_LONG
+		}
+		u, err := ParseTarget(rl.Method, rl.RequestTarget)
+		if err != nil {
+			return n, err
+		}
+		r.URL = u
 		r.RequestLine = *rl
 		r.state = headerState
 		parsedN = n
 	case headerState:
-		n, done, err := r.headers.Parse(unparsed_data)
+		if err := checkFieldLine(unparsed_data); err != nil {
+			return 0, err
+		}
+		n, done, err := r.Headers.Parse(unparsed_data)
 		if err != nil {
 			return n, errors.Join(fmt.Errorf("unable to parse headers data passed was: %q", unparsed_data), err)
 		}
 		if n == 0 {
+			// no CRLF yet, same as the request line don't wait for a line that's already too long
+			if r.headerBytes+len(unparsed_data) > r.limits.MaxHeaderBytes {
+				return 0, HEADERS_TOO_LARGE
+			}
 			break
 		}
 		if done == true {
+			if err := r.checkHost(); err != nil {
+				return n, err
+			}
+			if err := r.checkExpect(); err != nil {
+				return n, err
+			}
 			r.state = bodyState
+		} else {
+			r.headerBytes += n
+			r.headerCount++
+			if r.headerBytes > r.limits.MaxHeaderBytes || r.headerCount > r.limits.MaxHeaderCount {
+				return 0, HEADERS_TOO_LARGE
+			}
 		}
 		parsedN = n
 	case bodyState:
-		content_len := r.headers.Get("content-length")
-		if content_len == "" || content_len == "0" {
-			r.state = finalState // assume no body to parse and we will finish
-		}
-		conLen, err := strconv.Atoi(content_len)
-		if err != nil {
-			return parsedN, errors.Join(fmt.Errorf("content-length header value could not be parsed as a string, header value = %q", r.headers.Get("content-length")), err)
-		}
-		if len(unparsed_data) < conLen {
-			break // parsedN should be 0 and tells us to read more bytes in. If body shorter than conLen then call to reader.Read() will eventually hit EOF
-		}
-		r.Body = unparsed_data[:conLen]
-		r.state = finalState
-	case finalState:
 		break
 	default:
 		panic("Skill issue")
@@ -96,15 +244,35 @@ func (r *Request) onePass(unparsed_data []byte) (int, error) {
 	return parsedN, nil
 }
 
+// checks the next field line in data (if a whole one is there) is something every parser reads the same way
+// a line starting with SP/HTAB is obs-fold, which an RFC 9112 parser joins onto the previous field's value instead of reading a new field,
+// and a bare CR/LF or NUL in a value ends the line early for some parsers. either way two parsers could disagree on where
+// the message ends (request smuggling) so both get rejected per RFC 9112 sections 5.2 and 5.5
+func checkFieldLine(data []byte) error {
+	idx := bytes.Index(data, CRLF)
+	if idx <= 0 {
+		return nil
+	}
+	line := data[:idx]
+	if line[0] == ' ' || line[0] == '\t' {
+		return fmt.Errorf("%w: %q", BAD_FIELD_LINE, line)
+	}
+	if bytes.ContainsAny(line, "\r\n\x00") {
+		return fmt.Errorf("%w: %q", BAD_FIELD_LINE, line)
+	}
+	return nil
+}
+
+// parses as much of the request line + headers out of data as it can
 func (r *Request) parse(data []byte) (int, error) {
 	read := 0
-	for r.state != finalState {
+	for r.state != bodyState {
 		parsedN, err := r.onePass(data[read:])
 		if err != nil {
 			return read, err
 		}
 		if parsedN == 0 {
-			break // signal that we need to pop up to RequestFromReader fn and read more data
+			break // signal that we need to pop up to ReadRequest fn and read more data
 		}
 		read += parsedN
 	}
@@ -114,16 +282,24 @@ func (r *Request) parse(data []byte) (int, error) {
 type RequestLine struct {
 	Method        string // ex. GET
 	RequestTarget string // ex. /admin/login
-	HttpVersion   string // ex. HTTP/1.1
+	HttpVersion   string // just the number, 1.1 or 1.0 (a later 1.x shows up as 1.1)
 }
 
-func newRequest() *Request {
+func newRequest(limits Limits) *Request {
 	return &Request{
-		headers: headers.NewHeaders(),
-		state:   initState,
+		Headers:  headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
+		state:    initState,
+		limits:   limits,
 	}
 }
 
+// checks version looks like DIGIT "." DIGIT
+func isVersionNumber(version string) bool {
+	return len(version) == 3 && version[1] == '.' &&
+		version[0] >= '0' && version[0] <= '9' && version[2] >= '0' && version[2] <= '9'
+}
+
 // reqline = method SP request-target SP HTTP-version
 func parseRequestLine(msg []byte) (*RequestLine, int, error) {
 	idx := bytes.Index(msg, CRLF)
@@ -137,10 +313,23 @@ func parseRequestLine(msg []byte) (*RequestLine, int, error) {
 		return nil, idx, BAD_REQ_LINE
 	}
 
+	// method = token, ex. an empty one from a leading space or G(T isn't a method
+	if parts[0] == "" || !headers.IsToken(parts[0]) {
+		return nil, idx, BAD_REQ_LINE
+	}
+
 	http, version, found := strings.Cut(parts[2], "/")
-	if !found || http != "HTTP" || version != "1.1" {
+	if !found || http != "HTTP" || !isVersionNumber(version) {
+		return nil, idx, BAD_REQ_LINE
+	}
+	// well formed but not one we speak, ex. HTTP/2.0 sent as text
+	if version[0] != '1' {
 		return nil, idx, UNSUPPORTED_HTTP_VERSION
 	}
+	// a later 1.x is handled as the highest minor version we implement (RFC 9110 section 2.5)
+	if version != "1.0" {
+		version = "1.1"
+	}
 
 	rl := RequestLine{
 		Method:        parts[0],
@@ -151,28 +340,138 @@ func parseRequestLine(msg []byte) (*RequestLine, int, error) {
 	return &rl, idx + len(CRLF), nil
 }
 
-func RequestFromReader(reader io.Reader) (*Request, error) {
-	buf := make([]byte, 1024)
-	req := newRequest()
-	bufLen := 0
-	for req.state != finalState {
-		n, err := reader.Read(buf[bufLen:])
-		// TODO: handle this error better
-		if err != nil {
-			return nil, errors.Join(fmt.Errorf("reader.Read() error while parsing request"), err)
+// Reader reads requests one after another off of a connection
+// bytes read past the end of one request are kept around for the next so pipelined requests work
+type Reader struct {
+	reader io.Reader
+	buf    []byte
+	bufLen int
+	body   *body // body of the last request read, has to be finished before the next request can be parsed
+	limits Limits
+}
+
+// NewReader makes a Reader that enforces DefaultLimits
+func NewReader(reader io.Reader) *Reader {
+	return NewReaderWithLimits(reader, DefaultLimits)
+}
+
+// NewReaderWithLimits makes a Reader that rejects requests going over limits, zero fields use the defaults
+func NewReaderWithLimits(reader io.Reader, limits Limits) *Reader {
+	// buffer starts small and grows as far as the limits need it to
+	return &Reader{reader: reader, buf: make([]byte, 1024), limits: limits.withDefaults()}
+}
+
+// Buffered is how many bytes have already been read off the underlying reader but not parsed yet
+func (rr *Reader) Buffered() int {
+	return rr.bufLen
+}
+
+// Fill blocks until there's at least one unparsed byte in the buffer, reading from the underlying reader if needed
+// lets a caller wait for the next request to start (ex. with an idle timeout) before actually parsing it
+func (rr *Reader) Fill() error {
+	for rr.bufLen == 0 {
+		if err := rr.readMore(initState); err != nil {
+			return err
 		}
-		bufLen += n
-		parsed, err := req.parse(buf[:bufLen])
+	}
+	return nil
+}
+
+// ReadRequest parses the request line and headers of the next request, reading more from the underlying reader only when the buffer runs dry
+// the body is left on the connection for the handler to stream through req.Body
+// returns io.EOF itself (not wrapped) only when the reader ends cleanly before any bytes of a new request
+func (rr *Reader) ReadRequest() (*Request, error) {
+	if rr.body != nil && rr.body.state != bodyDoneState {
+		return nil, BODY_NOT_DRAINED
+	}
+	req := newRequest(rr.limits)
+	for {
+		// parse whatever is left over first since a pipelined request may already be sitting in the buffer
+		parsed, err := req.parse(rr.buf[:rr.bufLen])
 		if err != nil {
 			return nil, err
 		}
-		// overwrite parsed data instead of setting buf = buf[parsed:]
-		// which would cause buffer to get smaller every iteration
-		copy(buf, buf[parsed:bufLen])
-		bufLen -= parsed
+		rr.discard(parsed)
+		if req.state == bodyState {
+			break
+		}
+
+		err = rr.readMore(req.state)
+		if err == io.EOF && rr.bufLen == 0 && req.state == initState {
+			return nil, io.EOF
+		}
+		if err != nil {
+			// TODO: handle this error better
+			return nil, errors.Join(fmt.Errorf("reader.Read() error while parsing request"), err)
+		}
+	}
+
+	b, err := newBody(rr, req)
+	if err != nil {
+		return nil, err
+	}
+	rr.body = b
+	req.body = b
+	req.Body = b
+	return req, nil
+}
+
+// drops n parsed bytes off the front of the buffer
+func (rr *Reader) discard(n int) {
+	// overwrite parsed data instead of setting buf = buf[parsed:]
+	// which would cause buffer to get smaller every iteration
+	copy(rr.buf, rr.buf[n:rr.bufLen])
+	rr.bufLen -= n
+}
+
+// reads more off the underlying reader into the buffer, state is whatever we're stuck parsing and picks the error if it won't fit
+// returns the reader's error as is if nothing was read
+func (rr *Reader) readMore(state string) error {
+	if rr.bufLen == len(rr.buf) {
+		if len(rr.buf) >= rr.limits.maxBuffer() {
+			// buffer is as big as it gets and still couldn't parse the next piece so it's bigger than we'll ever fit
+			return tooLargeError(state)
+		}
+		rr.buf = append(rr.buf, make([]byte, min(len(rr.buf), rr.limits.maxBuffer()-len(rr.buf)))...)
+	}
+	n, err := rr.reader.Read(rr.buf[rr.bufLen:])
+	rr.bufLen += n
+	if n == 0 {
+		return err
+	}
+	return nil
+}
+
+// picks the error for whichever part of the request didn't fit in the buffer
+func tooLargeError(state string) error {
+	switch state {
+	case initState:
+		return REQ_LINE_TOO_LONG
+	case headerState, trailerState:
+		return HEADERS_TOO_LARGE
+	case chunkSizeState:
+		return BAD_CHUNK
+	default:
+		return BODY_TOO_LARGE
+	}
+}
+
+// RequestFromReader parses exactly one request out of reader, anything after it is an error
+// unlike Reader.ReadRequest the body gets read into memory up front
+func RequestFromReader(reader io.Reader) (*Request, error) {
+	rr := NewReader(reader)
+	req, err := rr.ReadRequest()
+	if err == io.EOF {
+		return nil, errors.Join(fmt.Errorf("reader.Read() error while parsing request"), err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := req.BufferBody(); err != nil {
+		return nil, err
 	}
-	if string(buf[:bufLen]) != "" {
-		return req, fmt.Errorf("Request reached final state but parsed data != read data, here is remaining data in buffer: \n%s\n", string(buf[:bufLen]))
+	if rr.bufLen != 0 {
+		return req, fmt.Errorf("Request reached final state but parsed data != read data, here is remaining data in buffer: \n%s\n", string(rr.buf[:rr.bufLen]))
 	}
 
 	return req, nil
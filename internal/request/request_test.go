@@ -2,10 +2,12 @@ package request
 
 import (
 	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"sina.http/internal/headers"
 )
 
 type chunkReader struct {
@@ -38,6 +40,13 @@ func checkRequestLineCorrect(method string, target string, r *Request, err error
 	assert.Equal(t, "1.1", r.RequestLine.HttpVersion)
 }
 
+// reads whatever is left of the request body
+func readBody(t *testing.T, r *Request) string {
+	data, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	return string(data)
+}
+
 // Example test structure
 func TestChunkReader(t *testing.T) {
 	reader := &chunkReader{
@@ -105,14 +114,22 @@ func TestRequestLineParse(t *testing.T) {
 func TestRequestsWithHeaders(t *testing.T) {
 	// Test: good request with normal headers
 	reader := &chunkReader{
-		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\n			User-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
 		numBytesPerRead: 3,
 	}
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
-	assert.Equal(t, r.headers.Get("HOST"), "localhost:42069")
-	assert.Equal(t, r.headers.Get("user-agent"), "curl/7.81.0")
-	assert.Equal(t, r.headers.Get("ACCEPT"), "*/*")
+	assert.Equal(t, r.Headers.Get("HOST"), "localhost:42069")
+	assert.Equal(t, r.Headers.Get("user-agent"), "curl/7.81.0")
+	assert.Equal(t, r.Headers.Get("ACCEPT"), "*/*")
+
+	// Test: a line starting with whitespace is obs-fold, not a new field, and gets rejected
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\n			User-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	assert.ErrorIs(t, err, BAD_FIELD_LINE)
 
 	// Test: headers with invalid characters
 	reader = &chunkReader{
@@ -137,7 +154,7 @@ func TestRequestsWithHeaders(t *testing.T) {
 	}
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
-	assert.Equal(t, r.headers.Get("accept"), "*/*, */*")
+	assert.Equal(t, r.Headers.Get("accept"), "*/*, */*")
 
 	// Missing End of Headers
 	reader = &chunkReader{
@@ -163,7 +180,7 @@ func TestRequestBodyParse(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "hello world!\n", string(r.Body))
+	assert.Equal(t, "hello world!\n", readBody(t, r))
 
 	// Test: Body shorter than reported content length
 	reader = &chunkReader{
@@ -177,3 +194,375 @@ func TestRequestBodyParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.Error(t, err)
 }
+
+func TestReaderPipelinedRequests(t *testing.T) {
+	// Test: leftover bytes from the first request are used for the second
+	reader := &chunkReader{
+		data: "POST /one HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 5\r\n\r\nhello" +
+			"GET /two HTTP/1.1\r\nHost: localhost:42069\r\nConnection: close\r\n\r\n",
+		numBytesPerRead: 7,
+	}
+	rr := NewReader(reader)
+	r, err := rr.ReadRequest()
+	checkRequestLineCorrect("POST", "/one", r, err, t)
+	assert.Equal(t, "hello", readBody(t, r))
+	assert.True(t, r.KeepAlive())
+
+	r, err = rr.ReadRequest()
+	checkRequestLineCorrect("GET", "/two", r, err, t)
+	assert.False(t, r.KeepAlive())
+
+	// Test: clean EOF between requests is reported as plain io.EOF
+	_, err = rr.ReadRequest()
+	assert.Equal(t, io.EOF, err)
+
+	// Test: EOF in the middle of a request is a real error
+	rr = NewReader(&chunkReader{data: "GET / HTTP/1.1\r\nHost: local", numBytesPerRead: 4})
+	_, err = rr.ReadRequest()
+	require.Error(t, err)
+	assert.NotEqual(t, io.EOF, err)
+}
+
+func TestTypedParseErrors(t *testing.T) {
+	// Test: malformed version is a bad request line
+	_, err := RequestFromReader(&chunkReader{data: "GET / HTTP-1.1\r\n\r\n", numBytesPerRead: 3})
+	assert.ErrorIs(t, err, BAD_REQ_LINE)
+
+	// Test: method has to be a non-empty token
+	for _, line := range []string{" / HTTP/1.1", "G(T / HTTP/1.1", "GE\tT / HTTP/1.1"} {
+		_, err = RequestFromReader(strings.NewReader(line + "\r\nHost: x\r\n\r\n"))
+		assert.ErrorIs(t, err, BAD_REQ_LINE, line)
+	}
+
+	// Test: well formed but unsupported version
+	_, err = RequestFromReader(&chunkReader{data: "GET / HTTP/2.0\r\n\r\n", numBytesPerRead: 3})
+	assert.ErrorIs(t, err, UNSUPPORTED_HTTP_VERSION)
+	var pe *ParseError
+	require.ErrorAs(t, err, &pe)
+	assert.Equal(t, 505, pe.StatusCode())
+
+	// Test: bad header surfaces the headers package error
+	_, err = RequestFromReader(&chunkReader{data: "GET / HTTP/1.1\r\nHo st: x\r\n\r\n", numBytesPerRead: 3})
+	assert.ErrorIs(t, err, headers.BAD_HEADER)
+
+	// Test: negative content-length
+	_, err = RequestFromReader(&chunkReader{data: "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: -1\r\n\r\n", numBytesPerRead: 3})
+	assert.ErrorIs(t, err, BAD_CONTENT_LENGTH)
+
+	// Test: headers over the default limit
+	_, err = RequestFromReader(&chunkReader{data: "GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("a", DefaultLimits.MaxHeaderBytes) + "\r\n\r\n", numBytesPerRead: 4096})
+	assert.ErrorIs(t, err, HEADERS_TOO_LARGE)
+
+	// Test: request target over the default limit
+	_, err = RequestFromReader(&chunkReader{data: "GET /" + strings.Repeat("a", DefaultLimits.MaxURILength) + " HTTP/1.1\r\n\r\n", numBytesPerRead: 100})
+	assert.ErrorIs(t, err, REQ_LINE_TOO_LONG)
+}
+
+func TestLimits(t *testing.T) {
+	limits := Limits{MaxURILength: 20, MaxHeaderBytes: 100, MaxHeaderCount: 3, MaxBodySize: 10}
+	read := func(data string) (*Request, error) {
+		rr := NewReaderWithLimits(&chunkReader{data: data, numBytesPerRead: 7}, limits)
+		return rr.ReadRequest()
+	}
+
+	// Test: everything right at the limits is fine, and headers bigger than the starting buffer still fit
+	_, err := read("GET /" + strings.Repeat("a", 19) + " HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\n0123456789")
+	require.NoError(t, err)
+	big := NewReaderWithLimits(&chunkReader{data: "GET / HTTP/1.1\r\nHost: x\r\nX: " + strings.Repeat("a", 3000) + "\r\n\r\n", numBytesPerRead: 500}, Limits{})
+	_, err = big.ReadRequest()
+	require.NoError(t, err)
+
+	// Test: 431 for one header too many
+	_, err = read("GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n")
+	assert.ErrorIs(t, err, HEADERS_TOO_LARGE)
+
+	// Test: 414 for a long target, even before the line is finished
+	_, err = read("GET /" + strings.Repeat("a", 20) + " HTTP/1.1\r\n\r\n")
+	assert.ErrorIs(t, err, REQ_LINE_TOO_LONG)
+	_, err = read("GET /" + strings.Repeat("a", 200))
+	assert.ErrorIs(t, err, REQ_LINE_TOO_LONG)
+
+	// Test: 431 for too many header bytes, even before the line is finished
+	_, err = read("GET / HTTP/1.1\r\nX: " + strings.Repeat("a", 100) + "\r\n\r\n")
+	assert.ErrorIs(t, err, HEADERS_TOO_LARGE)
+	_, err = read("GET / HTTP/1.1\r\nX: " + strings.Repeat("a", 200))
+	assert.ErrorIs(t, err, HEADERS_TOO_LARGE)
+
+	// Test: 413 up front for a Content-Length over the limit
+	_, err = read("POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 11\r\n\r\n01234567890")
+	assert.ErrorIs(t, err, BODY_TOO_LARGE)
+	var pe *ParseError
+	require.ErrorAs(t, err, &pe)
+	assert.Equal(t, 413, pe.StatusCode())
+
+	// Test: 413 from Body.Read once a chunked body goes over the limit
+	r, err := read("POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n")
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	assert.ErrorIs(t, err, BODY_TOO_LARGE)
+
+	// Test: no body limit by default
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 20\r\n\r\n" + strings.Repeat("a", 20)))
+	require.NoError(t, err)
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Len(t, body, 20)
+	assert.Equal(t, int64(-1), Limits{}.withDefaults().MaxBodySize)
+}
+
+func TestChunkedBodyParse(t *testing.T) {
+	// Test: chunks with extensions and trailers, read a few bytes at a time
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n" +
+			"7;note=\"ext\"\r\n world!\r\n" +
+			"0\r\n" +
+			"Expires: never\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!", readBody(t, r))
+	assert.Equal(t, "never", r.Trailers.Get("expires"))
+	assert.Equal(t, "", r.Headers.Get("expires"))
+
+	// Test: chunk bigger than the read buffer
+	big := strings.Repeat("a", 3000)
+	reader = &chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\nbb8\r\n" + big + "\r\n0\r\n\r\n",
+		numBytesPerRead: 500,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, big, readBody(t, r))
+
+	// Test: whole request in one read with no trailers
+	data := "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n"
+	r, err = RequestFromReader(&chunkReader{data: data, numBytesPerRead: len(data)})
+	require.NoError(t, err)
+	assert.Equal(t, "abc", readBody(t, r))
+
+	// Test: bad chunk size
+	_, err = RequestFromReader(&chunkReader{data: "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nabc\r\n0\r\n\r\n", numBytesPerRead: 3})
+	assert.ErrorIs(t, err, BAD_CHUNK)
+
+	// Test: chunk data longer than its size
+	_, err = RequestFromReader(&chunkReader{data: "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nabc\r\n0\r\n\r\n", numBytesPerRead: 3})
+	assert.ErrorIs(t, err, BAD_CHUNK)
+}
+
+func TestStreamingBody(t *testing.T) {
+	// Test: body way bigger than the read buffer streams through
+	big := strings.Repeat("0123456789", 100_000)
+	reader := &chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nHost: x\r\nContent-Length: 1000000\r\n\r\n" + big,
+		numBytesPerRead: 4000,
+	}
+	rr := NewReader(reader)
+	r, err := rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, big, readBody(t, r))
+
+	// Test: next request can't be read while the body is still on the connection
+	reader = &chunkReader{
+		data: "POST /one HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nhello" +
+			"GET /two HTTP/1.1\r\nHost: x\r\n\r\n",
+		numBytesPerRead: 100,
+	}
+	rr = NewReader(reader)
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	_, err = rr.ReadRequest()
+	assert.ErrorIs(t, err, BODY_NOT_DRAINED)
+
+	// Test: closing the body throws the unread part away so the next request can be read
+	require.NoError(t, r.Body.Close())
+	_, err = r.Body.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, BODY_CLOSED)
+	r, err = rr.ReadRequest()
+	checkRequestLineCorrect("GET", "/two", r, err, t)
+	assert.Equal(t, "", readBody(t, r))
+
+	// Test: body too big to drain leaves the connection unusable
+	reader = &chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nHost: x\r\nContent-Length: 1000000\r\n\r\n" + big,
+		numBytesPerRead: 4000,
+	}
+	rr = NewReader(reader)
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	assert.ErrorIs(t, r.Body.Close(), BODY_NOT_DRAINED)
+}
+
+func TestHTTP10(t *testing.T) {
+	// Test: 1.0 requests parse and aren't persistent by default
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	assert.False(t, r.KeepAlive())
+
+	// Test: unless they ask for keep-alive
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	// Test: 1.1 stays persistent unless told otherwise
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+
+	// Test: a later 1.x is treated as 1.1
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.2\r\nHost: x\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.1", r.RequestLine.HttpVersion)
+
+	// Test: anything else well formed is still a 505
+	for _, v := range []string{"0.9", "2.0", "3.0"} {
+		_, err = RequestFromReader(strings.NewReader("GET / HTTP/" + v + "\r\n\r\n"))
+		assert.ErrorIs(t, err, UNSUPPORTED_HTTP_VERSION, v)
+	}
+}
+
+func TestSmugglingDefenses(t *testing.T) {
+	parse := func(hdrs string) (*Request, error) {
+		return RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\n" + hdrs + "\r\nhello"))
+	}
+
+	// Test: repeated identical Content-Length is fine, in separate fields or one list
+	for _, h := range []string{"Content-Length: 5\r\nContent-Length: 5\r\n", "Content-Length: 5, 5\r\n", "Content-Length: 005\r\n"} {
+		r, err := parse(h)
+		require.NoError(t, err, h)
+		assert.Equal(t, "hello", readBody(t, r))
+	}
+
+	// Test: differing, signed, empty or non-numeric lengths are a 400
+	for _, h := range []string{
+		"Content-Length: 5\r\nContent-Length: 6\r\n",
+		"Content-Length: 5, 6\r\n",
+		"Content-Length: -5\r\n",
+		"Content-Length: +5\r\n",
+		"Content-Length: \r\n",
+		"Content-Length: 5,\r\n",
+		"Content-Length: 0x5\r\n",
+		"Content-Length: 5 5\r\n",
+		"Content-Length: 99999999999999999999\r\n",
+	} {
+		_, err := parse(h)
+		assert.ErrorIs(t, err, BAD_CONTENT_LENGTH, h)
+	}
+
+	// Test: Transfer-Encoding together with Content-Length
+	_, err := parse("Transfer-Encoding: chunked\r\nContent-Length: 5\r\n")
+	assert.ErrorIs(t, err, CONFLICTING_FRAMING)
+	_, err = parse("Content-Length: 5\r\nTransfer-Encoding: chunked\r\n")
+	assert.ErrorIs(t, err, CONFLICTING_FRAMING)
+
+	// Test: chunked has to be there exactly once and last
+	for _, h := range []string{
+		"Transfer-Encoding: chunked, gzip\r\n",
+		"Transfer-Encoding: chunked\r\nTransfer-Encoding: gzip\r\n",
+		"Transfer-Encoding: chunked, chunked\r\n",
+		"Transfer-Encoding: gzip\r\n",
+		"Transfer-Encoding: \r\n",
+		"Transfer-Encoding: chunked,\r\n",
+	} {
+		_, err := parse(h)
+		assert.ErrorIs(t, err, BAD_TRANSFER_ENCODING, h)
+	}
+
+	// Test: codings we can't decode in front of chunked are a 501
+	_, err = parse("Transfer-Encoding: gzip, chunked\r\n")
+	assert.ErrorIs(t, err, UNSUPPORTED_TRANSFER_CODING)
+	var pe *ParseError
+	require.ErrorAs(t, err, &pe)
+	assert.Equal(t, 501, pe.StatusCode())
+
+	// Test: Transfer-Encoding in a 1.0 request isn't trusted
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"))
+	assert.ErrorIs(t, err, BAD_TRANSFER_ENCODING)
+
+	// Test: case doesn't matter for the coding name
+	r, err := RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: Chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", readBody(t, r))
+
+	// Test: a folded line would be part of Host to an RFC 9112 parser, not a Transfer-Encoding of its own
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\n Transfer-Encoding: chunked\r\n\r\n0\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: x\r\n\r\n"))
+	assert.ErrorIs(t, err, BAD_FIELD_LINE)
+	require.ErrorAs(t, err, &pe)
+	assert.Equal(t, 400, pe.StatusCode())
+
+	// Test: bare CR, LF or NUL in a value
+	for _, h := range []string{"X-A: a\nTransfer-Encoding: chunked\r\n", "X-A: a\rb\r\n", "X-A: a\x00b\r\n"} {
+		_, err := parse(h)
+		assert.ErrorIs(t, err, BAD_FIELD_LINE, h)
+	}
+
+	// Test: same rules for trailers
+	for _, tr := range []string{"X-A: a\r\n X-B: b\r\n", "X-A: a\nb\r\n", "X-A: a\x00\r\n"} {
+		r, err := NewReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n" + tr + "\r\n")).ReadRequest()
+		require.NoError(t, err)
+		_, err = io.ReadAll(r.Body)
+		assert.ErrorIs(t, err, BAD_FIELD_LINE, tr)
+		assert.ErrorIs(t, r.BodyError(), BAD_FIELD_LINE, tr)
+	}
+}
+
+func TestHostHeader(t *testing.T) {
+	// Test: 1.1 needs exactly one valid Host
+	_, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+	assert.ErrorIs(t, err, MISSING_HOST)
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: a.test\r\nhost: a.test\r\n\r\n"))
+	assert.ErrorIs(t, err, BAD_HOST)
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: a test\r\n\r\n"))
+	assert.ErrorIs(t, err, BAD_HOST)
+	var pe *ParseError
+	require.ErrorAs(t, err, &pe)
+	assert.Equal(t, 400, pe.StatusCode())
+
+	// Test: empty Host is allowed, and so is leaving it out on 1.0
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost:\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "", r.Host())
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "", r.Host())
+
+	// Test: Host() prefers an absolute-form target's authority
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: [::1]:8080\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "[::1]:8080", r.Host())
+	r, err = RequestFromReader(strings.NewReader("GET http://b.test/x HTTP/1.1\r\nHost: a.test\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "b.test", r.Host())
+}
+
+func TestBodyError(t *testing.T) {
+	rr := NewReaderWithLimits(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"), Limits{MaxBodySize: 3})
+	r, err := rr.ReadRequest()
+	require.NoError(t, err)
+	assert.NoError(t, r.BodyError())
+	// Test: error sticks around even after Body was swapped out by BufferBody
+	_, err = r.BufferBody()
+	assert.ErrorIs(t, err, BODY_TOO_LARGE)
+	assert.ErrorIs(t, r.BodyError(), BODY_TOO_LARGE)
+
+}
+
+func TestPrintLeavesBody(t *testing.T) {
+	// ReadRequest rather than RequestFromReader since that one buffers the body itself
+	r, err := NewReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nhello")).ReadRequest()
+	require.NoError(t, err)
+	// Test: printing doesn't read the body out from under the handler
+	r.Print()
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
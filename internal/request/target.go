@@ -0,0 +1,322 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+var BAD_TARGET = &ParseError{Status: 400, Msg: "invalid request target"}
+var BAD_PATH = &ParseError{Status: 400, Msg: "request path tries to escape its directory"}
+
+// the four request target forms from RFC 9112 section 3.2
+const (
+	OriginForm    = "origin"    // ex. /where?q=now, what almost every request uses
+	AbsoluteForm  = "absolute"  // ex. http://www.example.org/pub/WWW/, sent to proxies
+	AuthorityForm = "authority" // ex. www.example.com:80, only for CONNECT
+	AsteriskForm  = "asterisk"  // *, only for a server wide OPTIONS
+)
+
+// URL is the request target broken into its parts
+type URL struct {
+	Form     string
+	Scheme   string // only set for absolute-form
+	Host     string // host[:port] for absolute-form and authority-form
+	Path     string // normalized path (see NormalizePath), still percent-encoded. "/" for absolute-form without one and "" for authority/asterisk-form
+	RawPath  string // path exactly as the client sent it
+	RawQuery string // everything after the ?, without it
+	Query    Query
+	Segments []string // percent-decoded path segments, ex. /a%20b/c/ -> ["a b", "c", ""]
+}
+
+// Query is the parsed query string, a key maps to every value it was given in order
+type Query map[string][]string
+
+// Get returns the first value for key, or "" if there isn't one
+func (q Query) Get(key string) string {
+	if vals := q[key]; len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+func (q Query) Has(key string) bool {
+	_, ok := q[key]
+	return ok
+}
+
+// ParseTarget parses target the way a request with method should have sent it
+// anything invalid is a BAD_TARGET, except paths NormalizePath refuses which stay a BAD_PATH
+func ParseTarget(method, target string) (*URL, error) {
+	u, err := parseTarget(method, target)
+	if errors.Is(err, BAD_PATH) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %w", BAD_TARGET, target, err)
+	}
+	return u, nil
+}
+
+func parseTarget(method, target string) (*URL, error) {
+	switch {
+	case method == "CONNECT":
+		// CONNECT is the only method that uses authority-form and it can't use anything else
+		if !isAuthority(target) || !hasPort(target) {
+			return nil, fmt.Errorf("CONNECT needs host:port")
+		}
+		return &URL{Form: AuthorityForm, Host: target, Query: Query{}}, nil
+	case target == "*":
+		if method != "OPTIONS" {
+			return nil, fmt.Errorf("* is only allowed for OPTIONS")
+		}
+		return &URL{Form: AsteriskForm, Query: Query{}}, nil
+	case strings.HasPrefix(target, "/"):
+		u := &URL{Form: OriginForm}
+		return u, u.setPathAndQuery(target)
+	}
+
+	// absolute-form = scheme "://" authority path-abempty [ "?" query ]
+	scheme, rest, ok := strings.Cut(target, "://")
+	if !ok || !isScheme(scheme) {
+		return nil, fmt.Errorf("not a valid target form")
+	}
+	end := strings.IndexAny(rest, "/?")
+	if end == -1 {
+		end = len(rest)
+	}
+	host, pathQuery := rest[:end], rest[end:]
+	if !isAuthority(host) {
+		return nil, fmt.Errorf("bad authority %q", host)
+	}
+	if !strings.HasPrefix(pathQuery, "/") {
+		// path-abempty can be empty, the request is for the root then
+		pathQuery = "/" + pathQuery
+	}
+	u := &URL{Form: AbsoluteForm, Scheme: strings.ToLower(scheme), Host: host}
+	return u, u.setPathAndQuery(pathQuery)
+}
+
+// splits an absolute path + optional query into u's fields, target has to start with /
+func (u *URL) setPathAndQuery(target string) error {
+	path, rawQuery, _ := strings.Cut(target, "?")
+	if !validChars(path, "/") || !validChars(rawQuery, "/?") {
+		// also catches a fragment, # isn't allowed in a request target
+		return fmt.Errorf("invalid character")
+	}
+	norm, err := NormalizePath(path)
+	if err != nil {
+		return err
+	}
+	u.Path = norm
+	u.RawPath = path
+	u.RawQuery = rawQuery
+
+	u.Segments = []string{}
+	if norm != "/" {
+		for _, seg := range strings.Split(norm[1:], "/") {
+			decoded, err := url.PathUnescape(seg)
+			if err != nil {
+				return err
+			}
+			u.Segments = append(u.Segments, decoded)
+		}
+	}
+
+	u.Query = Query{}
+	if rawQuery == "" {
+		return nil
+	}
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(pair, "=")
+		key, err := url.QueryUnescape(k)
+		if err != nil {
+			return err
+		}
+		val, err := url.QueryUnescape(v)
+		if err != nil {
+			return err
+		}
+		u.Query[key] = append(u.Query[key], val)
+	}
+	return nil
+}
+
+// NormalizePath puts an absolute path into canonical form so paths that mean the same thing look the same to routing:
+// percent-encoded unreserved chars get decoded (%7E -> ~) and other escapes uppercased, duplicate slashes collapse
+// and . / .. segments get resolved, ex. /a//./b/../c -> /a/c
+// returns BAD_PATH for anything trying to sneak past a handler that maps paths to files: an encoded slash, backslash or NUL,
+// a . or .. segment spelled with escapes (%2e%2e) or a .. that would climb above /
+func NormalizePath(path string) (string, error) {
+	segs := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	out := make([]string, 0, len(segs))
+	for i, seg := range segs {
+		last := i == len(segs)-1
+		norm, err := normalizeSegment(seg)
+		if err != nil {
+			return "", fmt.Errorf("%w: %q: %w", BAD_PATH, path, err)
+		}
+		switch norm {
+		case "", ".":
+			// empty segments from duplicate slashes and . go away, but a trailing one keeps the trailing slash
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			if len(out) == 0 {
+				return "", fmt.Errorf("%w: %q goes above /", BAD_PATH, path)
+			}
+			out = out[:len(out)-1]
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, norm)
+		}
+	}
+	return "/" + strings.Join(out, "/"), nil
+}
+
+// decodes escapes of unreserved chars in one path segment and uppercases the rest
+func normalizeSegment(seg string) (string, error) {
+	var b strings.Builder
+	encodedDot := false
+	for i := 0; i < len(seg); i++ {
+		if seg[i] != '%' || i+2 >= len(seg) || !isHex(seg[i+1]) || !isHex(seg[i+2]) {
+			b.WriteByte(seg[i])
+			continue
+		}
+		c := unhex(seg[i+1])<<4 | unhex(seg[i+2])
+		switch {
+		case c == '/' || c == '\\' || c == 0:
+			return "", fmt.Errorf("encoded %q", c)
+		case isUnreserved(c):
+			encodedDot = encodedDot || c == '.'
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+		i += 2
+	}
+	norm := b.String()
+	if encodedDot && (norm == "." || norm == "..") {
+		return "", fmt.Errorf("encoded dot segment %q", seg)
+	}
+	return norm, nil
+}
+
+func unhex(c byte) byte {
+	switch {
+	case isDigit(c):
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+// checks every char in s is a pchar (unreserved / pct-encoded / sub-delims / ":" / "@") or one of extra
+// percent escapes have to be a % followed by two hex digits
+func validChars(s, extra string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '%':
+			if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+				return false
+			}
+			i += 2
+		case isUnreserved(c) || strings.IndexByte("!$&'()*+,;=:@", c) != -1 || strings.IndexByte(extra, c) != -1:
+			continue
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// authority = host [ ":" port ], userinfo isn't allowed in http(s) targets
+func isAuthority(s string) bool {
+	if s == "" {
+		return false
+	}
+	host, port := s, ""
+	if strings.HasPrefix(s, "[") {
+		// IP-literal, ex. [::1]:8080
+		end := strings.IndexByte(s, ']')
+		if end == -1 || !validIPLiteral(s[1:end]) {
+			return false
+		}
+		host, port = s[:end+1], s[end+1:]
+		if port != "" && port[0] != ':' {
+			return false
+		}
+		port = strings.TrimPrefix(port, ":")
+	} else if i := strings.LastIndexByte(s, ':'); i != -1 {
+		host, port = s[:i], s[i+1:]
+		if host == "" || !validChars(host, "") || strings.ContainsAny(host, ":@") {
+			return false
+		}
+	} else if !validChars(host, "") || strings.Contains(host, "@") {
+		return false
+	}
+	for i := 0; i < len(port); i++ {
+		if port[i] < '0' || port[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// reports whether authority s ends in a non-empty :port
+func hasPort(s string) bool {
+	i := strings.LastIndexByte(s, ':')
+	return i != -1 && i != len(s)-1 && !strings.Contains(s[i:], "]")
+}
+
+func validIPLiteral(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isHex(s[i]) && s[i] != ':' && s[i] != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// scheme = ALPHA *( ALPHA / DIGIT / "+" / "-" / "." )
+func isScheme(s string) bool {
+	if s == "" || !isAlpha(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if !isAlpha(c) && !isDigit(c) && c != '+' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func isUnreserved(c byte) bool {
+	return isAlpha(c) || isDigit(c) || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHex(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
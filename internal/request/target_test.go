@@ -0,0 +1,145 @@
+package request
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTarget(t *testing.T) {
+	// Test: origin-form with a multi-valued, percent-encoded query
+	u, err := ParseTarget("GET", "/search/caf%C3%A9/?q=go+lang&tag=a&tag=b%26c&empty=&flag")
+	require.NoError(t, err)
+	assert.Equal(t, OriginForm, u.Form)
+	assert.Equal(t, "/search/caf%C3%A9/", u.Path)
+	assert.Equal(t, "q=go+lang&tag=a&tag=b%26c&empty=&flag", u.RawQuery)
+	assert.Equal(t, []string{"search", "café", ""}, u.Segments)
+	assert.Equal(t, "go lang", u.Query.Get("q"))
+	assert.Equal(t, []string{"a", "b&c"}, u.Query["tag"])
+	assert.True(t, u.Query.Has("empty"))
+	assert.True(t, u.Query.Has("flag"))
+	assert.False(t, u.Query.Has("missing"))
+
+	// Test: root path has no segments
+	u, err = ParseTarget("GET", "/")
+	require.NoError(t, err)
+	assert.Empty(t, u.Segments)
+	assert.Empty(t, u.Query)
+
+	// Test: absolute-form, empty path means /
+	u, err = ParseTarget("GET", "HTTP://example.com:8080?x=1")
+	require.NoError(t, err)
+	assert.Equal(t, AbsoluteForm, u.Form)
+	assert.Equal(t, "http", u.Scheme)
+	assert.Equal(t, "example.com:8080", u.Host)
+	assert.Equal(t, "/", u.Path)
+	assert.Equal(t, "1", u.Query.Get("x"))
+	u, err = ParseTarget("GET", "http://[::1]/a")
+	require.NoError(t, err)
+	assert.Equal(t, "[::1]", u.Host)
+	assert.Equal(t, []string{"a"}, u.Segments)
+
+	// Test: authority-form for CONNECT
+	u, err = ParseTarget("CONNECT", "example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, AuthorityForm, u.Form)
+	assert.Equal(t, "example.com:443", u.Host)
+	assert.Equal(t, "", u.Path)
+
+	// Test: asterisk-form for OPTIONS
+	u, err = ParseTarget("OPTIONS", "*")
+	require.NoError(t, err)
+	assert.Equal(t, AsteriskForm, u.Form)
+
+	// Test: invalid targets
+	bad := []struct{ method, target string }{
+		{"GET", "*"},                 // asterisk only for OPTIONS
+		{"CONNECT", "/path"},         // CONNECT needs authority-form
+		{"CONNECT", "example.com"},   // ...with a port
+		{"GET", "example.com:443"},   // authority-form for anything else
+		{"GET", "/a#frag"},           // fragments aren't sent
+		{"GET", "/a%2"},              // truncated escape
+		{"GET", "/a%zz"},             // not hex
+		{"GET", "/a\x7fb"},           // control char
+		{"GET", "/caf\xc3\xa9"},      // raw non-ascii
+		{"GET", "/a?q=%G1"},          // bad escape in query
+		{"GET", "http://"},           // empty authority
+		{"GET", "http://user@host/"}, // userinfo
+		{"GET", "http://host:80x/"},  // bad port
+		{"GET", "1http://host/"},     // bad scheme
+		{"GET", "relative/path"},     // not any form
+		{"GET", "http://[zz::1]/"},   // bad ip literal
+	}
+	for _, c := range bad {
+		_, err := ParseTarget(c.method, c.target)
+		assert.ErrorIs(t, err, BAD_TARGET, "%s %q", c.method, c.target)
+	}
+}
+
+func TestRequestURL(t *testing.T) {
+	// Test: parsed target ends up on the request
+	r, err := RequestFromReader(strings.NewReader("GET /items/42?sort=asc HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "/items/42", r.URL.Path)
+	assert.Equal(t, "asc", r.URL.Query.Get("sort"))
+
+	// Test: invalid target is a 400
+	_, err = RequestFromReader(strings.NewReader("GET /a#b HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	assert.ErrorIs(t, err, BAD_TARGET)
+	var pe *ParseError
+	require.ErrorAs(t, err, &pe)
+	assert.Equal(t, 400, pe.StatusCode())
+}
+
+func TestNormalizePath(t *testing.T) {
+	cases := map[string]string{
+		"/":                "/",
+		"//":               "/",
+		"/a//b///c":        "/a/b/c",
+		"/a/./b/":          "/a/b/",
+		"/a/b/../c":        "/a/c",
+		"/a/b/..":          "/a/",
+		"/a/.":             "/a/",
+		"/%7Euser/%41bc":   "/~user/Abc",
+		"/caf%c3%a9":       "/caf%C3%A9",
+		"/a%20b":           "/a%20b",
+		"/a/..%2e.txt":     "/a/....txt",
+		"/docs/./../index": "/index",
+	}
+	for in, want := range cases {
+		got, err := NormalizePath(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+
+	// Test: traversal attempts are rejected rather than resolved
+	for _, in := range []string{
+		"/..",
+		"/a/../../etc/passwd",
+		"/%2e%2e/etc/passwd",
+		"/a/%2E%2e/b",
+		"/a/.%2e",
+		"/a/%2e",
+		"/static/..%2fsecret",
+		"/static/%2F",
+		"/static/..%5csecret",
+		"/a%00.txt",
+	} {
+		_, err := NormalizePath(in)
+		assert.ErrorIs(t, err, BAD_PATH, in)
+	}
+
+	// Test: the request keeps both, and traversal is a 400 before anything routes it
+	u, err := ParseTarget("GET", "/a//b/../c?x=1")
+	require.NoError(t, err)
+	assert.Equal(t, "/a/c", u.Path)
+	assert.Equal(t, "/a//b/../c", u.RawPath)
+	assert.Equal(t, []string{"a", "c"}, u.Segments)
+	_, err = RequestFromReader(strings.NewReader("GET /files/%2e%2e/%2e%2e/etc/passwd HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	assert.ErrorIs(t, err, BAD_PATH)
+	var pe *ParseError
+	require.ErrorAs(t, err, &pe)
+	assert.Equal(t, 400, pe.StatusCode())
+}
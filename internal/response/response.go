@@ -3,29 +3,41 @@ package response
 import (
 	"fmt"
 	"io"
+	"time"
 
 	"sina.http/internal/headers"
 )
 
-const (
-	StatusCodeOk     = "200 OK"
-	StatusCodeBadReq = "400 Bad Request"
-	StatusCodeISE    = "500 Internal Server Error"
-)
+var CRLF = []byte("\r\n")
+
+// TimeFormat is the IMF-fixdate format HTTP dates are sent in, times have to be in UTC
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// FormatDate formats t for a header like Date or Last-Modified, ex. Sun, 06 Nov 1994 08:49:37 GMT
+func FormatDate(t time.Time) string {
+	return t.UTC().Format(TimeFormat)
+}
+
+// WriteStatusLine writes the status line with the registered reason phrase for statusCode
+// codes without one still get the space before the (empty) reason since the grammar requires it
+func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
+	return WriteStatusLineWithReason(w, statusCode, statusCode.Reason())
+}
 
-func WriteStatusLine(w io.Writer, statusCode int) error {
-	var msg string
-	switch statusCode {
-	case 200:
-		msg = fmt.Sprintf("HTTP/1.1 %s", StatusCodeOk)
-	case 400:
-		msg = fmt.Sprintf("HTTP/1.1 %s", StatusCodeBadReq)
-	case 500:
-		msg = fmt.Sprintf("HTTP/1.1 %s", StatusCodeISE)
-	default:
-		msg = fmt.Sprintf("HTTP/1.1 %d", statusCode)
+// WriteStatusLineWithReason is WriteStatusLine with a custom reason phrase, ex. 200 "Everything's Fine"
+func WriteStatusLineWithReason(w io.Writer, statusCode StatusCode, reason string) error {
+	return writeStatusLine(w, "1.1", statusCode, reason)
+}
+
+// version is just the number, ex. 1.0
+func writeStatusLine(w io.Writer, version string, statusCode StatusCode, reason string) error {
+	if !statusCode.Valid() {
+		return fmt.Errorf("%w: %d", INVALID_STATUS_CODE, int(statusCode))
+	}
+	if !validReason(reason) {
+		return fmt.Errorf("%w: %q", INVALID_REASON_PHRASE, reason)
 	}
-	msg += "\r\n"
+	msg := fmt.Sprintf("HTTP/%s %03d %s\r\n", version, int(statusCode), reason)
 	n, err := w.Write([]byte(msg))
 	if err != nil {
 		return err
@@ -36,16 +48,20 @@ func WriteStatusLine(w io.Writer, statusCode int) error {
 	return nil
 }
 
-func GetDefaultHeaders(contentLen int) headers.Headers {
+func GetDefaultHeaders(contentLen int) *headers.Headers {
 	h := headers.NewHeaders()
-	h.Set("content-length", fmt.Sprintf("%d", contentLen))
-	h.Set("Connection", "close")
-	h.Set("Content-type", "text/plain")
+	h.Set("Content-Length", fmt.Sprintf("%d", contentLen))
+	h.Set("Content-Type", "text/plain")
 	return h
 }
 
-func WriteHeaders(w io.Writer, h headers.Headers) error {
-	for k, v := range h {
+// writes every field in the order it was added with its name spelled the way it was set, then the blank line that ends the headers
+// nothing gets written if any field would be unsafe to send
+func WriteHeaders(w io.Writer, h *headers.Headers) error {
+	if err := h.Validate(); err != nil {
+		return err
+	}
+	for k, v := range h.All() {
 		hdr := fmt.Appendf(nil, "%s: %s\r\n", k, v)
 		n, err := w.Write(hdr)
 		if err != nil {
@@ -0,0 +1,175 @@
+package response
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StatusCode is the three digit code at the start of every response
+type StatusCode int
+
+var INVALID_STATUS_CODE = fmt.Errorf("status code has to be between 100 and 599")
+var INVALID_REASON_PHRASE = fmt.Errorf("reason phrase can't contain control characters")
+
+// every code in the IANA HTTP status code registry, names follow the reason phrases
+const (
+	StatusCodeContinue           StatusCode = 100
+	StatusCodeSwitchingProtocols StatusCode = 101
+	StatusCodeProcessing         StatusCode = 102
+	StatusCodeEarlyHints         StatusCode = 103
+
+	StatusCodeOk                   StatusCode = 200
+	StatusCodeCreated              StatusCode = 201
+	StatusCodeAccepted             StatusCode = 202
+	StatusCodeNonAuthoritativeInfo StatusCode = 203
+	StatusCodeNoContent            StatusCode = 204
+	StatusCodeResetContent         StatusCode = 205
+	StatusCodePartialContent       StatusCode = 206
+	StatusCodeMultiStatus          StatusCode = 207
+	StatusCodeAlreadyReported      StatusCode = 208
+	StatusCodeIMUsed               StatusCode = 226
+
+	StatusCodeMultipleChoices   StatusCode = 300
+	StatusCodeMovedPermanently  StatusCode = 301
+	StatusCodeFound             StatusCode = 302
+	StatusCodeSeeOther          StatusCode = 303
+	StatusCodeNotModified       StatusCode = 304
+	StatusCodeUseProxy          StatusCode = 305
+	StatusCodeTemporaryRedirect StatusCode = 307
+	StatusCodePermanentRedirect StatusCode = 308
+
+	StatusCodeBadReq                     StatusCode = 400
+	StatusCodeUnauthorized               StatusCode = 401
+	StatusCodePaymentRequired            StatusCode = 402
+	StatusCodeForbidden                  StatusCode = 403
+	StatusCodeNotFound                   StatusCode = 404
+	StatusCodeMethodNotAllowed           StatusCode = 405
+	StatusCodeNotAcceptable              StatusCode = 406
+	StatusCodeProxyAuthRequired          StatusCode = 407
+	StatusCodeRequestTimeout             StatusCode = 408
+	StatusCodeConflict                   StatusCode = 409
+	StatusCodeGone                       StatusCode = 410
+	StatusCodeLengthRequired             StatusCode = 411
+	StatusCodePreconditionFailed         StatusCode = 412
+	StatusCodeContentTooLarge            StatusCode = 413
+	StatusCodeURITooLong                 StatusCode = 414
+	StatusCodeUnsupportedMediaType       StatusCode = 415
+	StatusCodeRangeNotSatisfiable        StatusCode = 416
+	StatusCodeExpectationFailed          StatusCode = 417
+	StatusCodeTeapot                     StatusCode = 418
+	StatusCodeMisdirectedRequest         StatusCode = 421
+	StatusCodeUnprocessableContent       StatusCode = 422
+	StatusCodeLocked                     StatusCode = 423
+	StatusCodeFailedDependency           StatusCode = 424
+	StatusCodeTooEarly                   StatusCode = 425
+	StatusCodeUpgradeRequired            StatusCode = 426
+	StatusCodePreconditionRequired       StatusCode = 428
+	StatusCodeTooManyRequests            StatusCode = 429
+	StatusCodeHeadersTooLarge            StatusCode = 431
+	StatusCodeUnavailableForLegalReasons StatusCode = 451
+
+	StatusCodeISE                   StatusCode = 500
+	StatusCodeNotImplemented        StatusCode = 501
+	StatusCodeBadGateway            StatusCode = 502
+	StatusCodeServiceUnavailable    StatusCode = 503
+	StatusCodeGatewayTimeout        StatusCode = 504
+	StatusCodeVersionNotSupp        StatusCode = 505
+	StatusCodeVariantAlsoNegotiates StatusCode = 506
+	StatusCodeInsufficientStorage   StatusCode = 507
+	StatusCodeLoopDetected          StatusCode = 508
+	StatusCodeNotExtended           StatusCode = 510
+	StatusCodeNetworkAuthRequired   StatusCode = 511
+)
+
+var reasonPhrases = map[StatusCode]string{
+	StatusCodeContinue:           "Continue",
+	StatusCodeSwitchingProtocols: "Switching Protocols",
+	StatusCodeProcessing:         "Processing",
+	StatusCodeEarlyHints:         "Early Hints",
+
+	StatusCodeOk:                   "OK",
+	StatusCodeCreated:              "Created",
+	StatusCodeAccepted:             "Accepted",
+	StatusCodeNonAuthoritativeInfo: "Non-Authoritative Information",
+	StatusCodeNoContent:            "No Content",
+	StatusCodeResetContent:         "Reset Content",
+	StatusCodePartialContent:       "Partial Content",
+	StatusCodeMultiStatus:          "Multi-Status",
+	StatusCodeAlreadyReported:      "Already Reported",
+	StatusCodeIMUsed:               "IM Used",
+
+	StatusCodeMultipleChoices:   "Multiple Choices",
+	StatusCodeMovedPermanently:  "Moved Permanently",
+	StatusCodeFound:             "Found",
+	StatusCodeSeeOther:          "See Other",
+	StatusCodeNotModified:       "Not Modified",
+	StatusCodeUseProxy:          "Use Proxy",
+	StatusCodeTemporaryRedirect: "Temporary Redirect",
+	StatusCodePermanentRedirect: "Permanent Redirect",
+
+	StatusCodeBadReq:                     "Bad Request",
+	StatusCodeUnauthorized:               "Unauthorized",
+	StatusCodePaymentRequired:            "Payment Required",
+	StatusCodeForbidden:                  "Forbidden",
+	StatusCodeNotFound:                   "Not Found",
+	StatusCodeMethodNotAllowed:           "Method Not Allowed",
+	StatusCodeNotAcceptable:              "Not Acceptable",
+	StatusCodeProxyAuthRequired:          "Proxy Authentication Required",
+	StatusCodeRequestTimeout:             "Request Timeout",
+	StatusCodeConflict:                   "Conflict",
+	StatusCodeGone:                       "Gone",
+	StatusCodeLengthRequired:             "Length Required",
+	StatusCodePreconditionFailed:         "Precondition Failed",
+	StatusCodeContentTooLarge:            "Content Too Large",
+	StatusCodeURITooLong:                 "URI Too Long",
+	StatusCodeUnsupportedMediaType:       "Unsupported Media Type",
+	StatusCodeRangeNotSatisfiable:        "Range Not Satisfiable",
+	StatusCodeExpectationFailed:          "Expectation Failed",
+	StatusCodeTeapot:                     "I'm a teapot",
+	StatusCodeMisdirectedRequest:         "Misdirected Request",
+	StatusCodeUnprocessableContent:       "Unprocessable Content",
+	StatusCodeLocked:                     "Locked",
+	StatusCodeFailedDependency:           "Failed Dependency",
+	StatusCodeTooEarly:                   "Too Early",
+	StatusCodeUpgradeRequired:            "Upgrade Required",
+	StatusCodePreconditionRequired:       "Precondition Required",
+	StatusCodeTooManyRequests:            "Too Many Requests",
+	StatusCodeHeadersTooLarge:            "Request Header Fields Too Large",
+	StatusCodeUnavailableForLegalReasons: "Unavailable For Legal Reasons",
+
+	StatusCodeISE:                   "Internal Server Error",
+	StatusCodeNotImplemented:        "Not Implemented",
+	StatusCodeBadGateway:            "Bad Gateway",
+	StatusCodeServiceUnavailable:    "Service Unavailable",
+	StatusCodeGatewayTimeout:        "Gateway Timeout",
+	StatusCodeVersionNotSupp:        "HTTP Version Not Supported",
+	StatusCodeVariantAlsoNegotiates: "Variant Also Negotiates",
+	StatusCodeInsufficientStorage:   "Insufficient Storage",
+	StatusCodeLoopDetected:          "Loop Detected",
+	StatusCodeNotExtended:           "Not Extended",
+	StatusCodeNetworkAuthRequired:   "Network Authentication Required",
+}
+
+// Reason is the registered reason phrase for c, or "" for codes that aren't in the registry
+func (c StatusCode) Reason() string {
+	return reasonPhrases[c]
+}
+
+// Valid reports whether c is in the 100-599 range the status classes cover
+func (c StatusCode) Valid() bool {
+	return c >= 100 && c <= 599
+}
+
+func (c StatusCode) String() string {
+	if reason := c.Reason(); reason != "" {
+		return fmt.Sprintf("%d %s", int(c), reason)
+	}
+	return fmt.Sprintf("%d", int(c))
+}
+
+// reason-phrase = *( HTAB / SP / VCHAR / obs-text ), anything else (ex. CR/LF) could break the status line
+func validReason(reason string) bool {
+	return !strings.ContainsFunc(reason, func(r rune) bool {
+		return r != '\t' && (r < ' ' || r == 0x7f)
+	})
+}
@@ -0,0 +1,66 @@
+package response
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusLine(t *testing.T) {
+	// Test: registered codes get their reason phrase
+	cases := map[StatusCode]string{
+		StatusCodeContinue:           "HTTP/1.1 100 Continue\r\n",
+		StatusCodeCreated:            "HTTP/1.1 201 Created\r\n",
+		StatusCodeNoContent:          "HTTP/1.1 204 No Content\r\n",
+		StatusCodePermanentRedirect:  "HTTP/1.1 308 Permanent Redirect\r\n",
+		StatusCodeTeapot:             "HTTP/1.1 418 I'm a teapot\r\n",
+		StatusCodeTooManyRequests:    "HTTP/1.1 429 Too Many Requests\r\n",
+		StatusCodeServiceUnavailable: "HTTP/1.1 503 Service Unavailable\r\n",
+	}
+	for code, want := range cases {
+		buf := &bytes.Buffer{}
+		require.NoError(t, WriteStatusLine(buf, code))
+		assert.Equal(t, want, buf.String())
+	}
+
+	// Test: valid but unregistered code keeps the space before an empty reason
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteStatusLine(buf, 299))
+	assert.Equal(t, "HTTP/1.1 299 \r\n", buf.String())
+
+	// Test: custom reason phrase
+	buf = &bytes.Buffer{}
+	require.NoError(t, WriteStatusLineWithReason(buf, StatusCodeOk, "All Good"))
+	assert.Equal(t, "HTTP/1.1 200 All Good\r\n", buf.String())
+
+	// Test: codes outside 100-599 and reasons with control characters are rejected without writing anything
+	buf = &bytes.Buffer{}
+	assert.ErrorIs(t, WriteStatusLine(buf, 99), INVALID_STATUS_CODE)
+	assert.ErrorIs(t, WriteStatusLine(buf, 600), INVALID_STATUS_CODE)
+	assert.ErrorIs(t, WriteStatusLine(buf, 1000), INVALID_STATUS_CODE)
+	assert.ErrorIs(t, WriteStatusLineWithReason(buf, 200, "OK\r\nSet-Cookie: evil=1"), INVALID_REASON_PHRASE)
+	assert.Equal(t, 0, buf.Len())
+
+	// Test: the writer checks the status up front too, and the response becomes a 500 instead of an implied 200
+	buf = &bytes.Buffer{}
+	w := NewWriter(buf)
+	assert.ErrorIs(t, w.WriteStatusLine(42), INVALID_STATUS_CODE)
+	_, err := w.WriteBody([]byte("hi"))
+	assert.ErrorIs(t, err, INVALID_STATUS_CODE)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 500 Internal Server Error\r\n"))
+	assert.True(t, strings.HasSuffix(buf.String(), "Content-Length: 0\r\nContent-Type: text/plain\r\n\r\n"))
+
+	// Test: same for a bad reason phrase
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	assert.ErrorIs(t, w.WriteStatusLineWithReason(StatusCodeOk, "Fine\r\n"), INVALID_REASON_PHRASE)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 500 Internal Server Error\r\n"))
+
+	assert.Equal(t, "404 Not Found", StatusCodeNotFound.String())
+	assert.Equal(t, "", StatusCode(299).Reason())
+}
@@ -0,0 +1,453 @@
+package response
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"sina.http/internal/headers"
+)
+
+var WRITE_OUT_OF_ORDER = fmt.Errorf("response written out of order, has to be status line -> headers -> body")
+var WRITE_AFTER_FINISH = fmt.Errorf("response already finished")
+var NOT_INFORMATIONAL = fmt.Errorf("informational responses have to be 1xx (but not 101)")
+var BODY_TOO_LONG = fmt.Errorf("body is longer than the Content-Length that was sent")
+var BODY_NOT_ALLOWED = fmt.Errorf("response status doesn't allow a body")
+
+// using string enum for better readability, same as the request parser
+// each state is the next thing the writer expects to be given
+const (
+	writeStatusState  = "status"
+	writeHeadersState = "headers"
+	writeBodyState    = "body"
+	writeDoneState    = "done"
+)
+
+// bodies up to this size get held back so we can send them with a Content-Length the handler didn't have to set
+const bufferLimit = 4096
+
+// Writer is what handlers use to send a response back over the connection
+// it enforces status line -> headers -> body and holds the status line + headers back until it knows how the body is framed
+type Writer struct {
+	w          io.Writer
+	version    string // HTTP version of the status line, matches the request's
+	state      string
+	statusCode StatusCode
+	reason     string
+	headers    *headers.Headers
+	defaults   *headers.Headers // added to the headers when they're sent unless the handler already set them
+	committed  bool             // status line and headers have actually gone out on the connection
+	buf        []byte           // body bytes held back while we still might be able to set Content-Length
+	chunked    bool             // body is being sent with Transfer-Encoding: chunked
+	closeConn  bool             // connection gets closed once this response is done
+	err        error            // first error writing to the connection, every call after that returns it too
+	failed     error            // the handler asked for a response that can't be sent, Finish sends a 500 instead
+	head       bool             // response to a HEAD request, headers as usual but the body never gets sent
+	bodyLen    int64            // body bytes the handler wrote for a HEAD response, becomes its Content-Length
+	// Content-Length that went out with the headers (-1 if the body isn't framed by one) and how much of it has been sent
+	// anything past it would be read by the client as the start of the next response
+	declaredLen int64
+	sentLen     int64
+	// request said Expect: 100-continue and we haven't sent the 100 yet, so the client may still be holding the body back
+	expectContinue bool
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, state: writeStatusState, version: "1.1", declaredLen: -1}
+}
+
+// SetVersion makes the response go out as the given HTTP version ("1.0" or "1.1") so it matches the request
+// an HTTP/1.0 client doesn't understand chunked bodies so those fall back to closing the connection to end the body
+// has to be called before the headers are sent to have any effect
+func (w *Writer) SetVersion(version string) {
+	w.version = version
+}
+
+// SetHead makes this the response to a HEAD request: the handler writes the same response it would for GET
+// and everything goes out except the body, Content-Length still says how long the body would have been
+func (w *Writer) SetHead() {
+	w.head = true
+}
+
+// SetExpectContinue tells the writer the client is waiting for a 100 Continue before sending the body
+// WriteContinue sends it, if the final response goes out first the connection gets closed after it
+// since the body may or may not be on its way and we can't tell where the next request would start
+func (w *Writer) SetExpectContinue() {
+	w.expectContinue = true
+}
+
+// WriteContinue sends the 100 Continue a client sending Expect: 100-continue is waiting for
+// does nothing if none is expected anymore or the final response has already gone out
+// the handler may have set the status and headers already, as long as they're still held back the 100 can go first
+func (w *Writer) WriteContinue() error {
+	if !w.expectContinue || w.committed {
+		return nil
+	}
+	w.expectContinue = false
+	return w.writeInformational(StatusCodeContinue, nil)
+}
+
+// WriteInformational sends a 1xx interim response (ex. 103 Early Hints with Link headers) right away, ahead of the final one
+// can be called any number of times before WriteStatusLine, h can be nil. 1.0 clients don't understand these so they're skipped
+// 101 isn't allowed since switching protocols would need the server to hand the connection over
+func (w *Writer) WriteInformational(statusCode StatusCode, h *headers.Headers) error {
+	if err := w.expect(writeStatusState, "WriteInformational"); err != nil {
+		return err
+	}
+	return w.writeInformational(statusCode, h)
+}
+
+// sends a 1xx without checking the state machine, only safe while nothing of the final response is on the wire
+func (w *Writer) writeInformational(statusCode StatusCode, h *headers.Headers) error {
+	if w.err != nil {
+		return w.err
+	}
+	if statusCode/100 != 1 || statusCode == StatusCodeSwitchingProtocols {
+		return fmt.Errorf("%w: %d", NOT_INFORMATIONAL, int(statusCode))
+	}
+	if h == nil {
+		h = headers.NewHeaders()
+	}
+	if err := h.Validate(); err != nil {
+		return err
+	}
+	if w.version == "1.0" {
+		return nil
+	}
+	if err := writeStatusLine(w.w, w.version, statusCode, statusCode.Reason()); err != nil {
+		w.err = err
+		return err
+	}
+	if err := WriteHeaders(w.w, h); err != nil {
+		w.err = err
+		return err
+	}
+	// the point is for the client to see it before the final response so don't let it sit in a buffer
+	if f, ok := w.w.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			w.err = err
+		}
+	}
+	return w.err
+}
+
+// SetClose makes the response go out with Connection: close and tells the server to hang up after it
+// has to be called before the headers are sent to have any effect on them
+func (w *Writer) SetClose() {
+	w.closeConn = true
+}
+
+// SetDefaultHeader makes the response go out with name: value unless the handler sets name itself
+// the server uses this for Date and Server, has to be called before the headers are sent to have any effect
+func (w *Writer) SetDefaultHeader(name, value string) {
+	if w.defaults == nil {
+		w.defaults = headers.NewHeaders()
+	}
+	w.defaults.Set(name, value)
+}
+
+// WillClose reports whether the connection has to be closed after this response
+// that's the case if someone asked for it, or if the response had no way for the client to tell where the body ends
+func (w *Writer) WillClose() bool {
+	return w.closeConn || !w.committed || w.err != nil
+}
+
+// Committed reports whether the status line and headers have already been sent, after that the response can't be changed
+func (w *Writer) Committed() bool {
+	return w.committed
+}
+
+// checks the writer is in state want before moving on, called step is just for the error message
+func (w *Writer) expect(want, step string) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.failed != nil {
+		return w.failed
+	}
+	if w.state == writeDoneState {
+		return WRITE_AFTER_FINISH
+	}
+	if w.state != want {
+		return fmt.Errorf("%w: %s called while expecting %s", WRITE_OUT_OF_ORDER, step, w.state)
+	}
+	return nil
+}
+
+// WriteStatusLine sets the response status, the reason phrase is the registered one for statusCode
+func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	return w.WriteStatusLineWithReason(statusCode, statusCode.Reason())
+}
+
+// WriteStatusLineWithReason is WriteStatusLine with a custom reason phrase
+// an invalid code or reason turns the response into a 500
+func (w *Writer) WriteStatusLineWithReason(statusCode StatusCode, reason string) error {
+	if err := w.expect(writeStatusState, "WriteStatusLine"); err != nil {
+		return err
+	}
+	// check now so a bad status doesn't only show up once the headers are on their way out
+	if !statusCode.Valid() {
+		return w.fail(fmt.Errorf("%w: %d", INVALID_STATUS_CODE, int(statusCode)))
+	}
+	if !validReason(reason) {
+		return w.fail(fmt.Errorf("%w: %q", INVALID_REASON_PHRASE, reason))
+	}
+	w.statusCode = statusCode
+	w.reason = reason
+	w.state = writeHeadersState
+	return nil
+}
+
+// WriteHeaders sets the response headers, they go out right away if h already says how long the body is
+// otherwise they wait for the body so a Content-Length can be filled in
+// a field that isn't safe to send (see headers.Validate) turns the response into a 500
+func (w *Writer) WriteHeaders(h *headers.Headers) error {
+	if err := w.expect(writeHeadersState, "WriteHeaders"); err != nil {
+		return err
+	}
+	// catch bad fields now rather than whenever the headers end up being sent
+	if err := h.Validate(); err != nil {
+		return w.fail(err)
+	}
+	w.headers = h
+	w.state = writeBodyState
+	if w.bodyIsFramed() {
+		return w.commit()
+	}
+	return nil
+}
+
+// WriteBody writes part of the body, if nothing has been written yet it implies a 200 with plain text headers
+// bytes past the Content-Length that was sent, or any body for a status that can't have one (1xx, 204, 304), are refused
+func (w *Writer) WriteBody(p []byte) (int, error) {
+	if w.state == writeStatusState && w.err == nil {
+		w.WriteStatusLine(StatusCodeOk)
+		h := headers.NewHeaders()
+		h.Set("Content-Type", "text/plain")
+		w.WriteHeaders(h)
+	}
+	if err := w.expect(writeBodyState, "WriteBody"); err != nil {
+		return 0, err
+	}
+	if !w.statusAllowsBody() {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("%w: %d", BODY_NOT_ALLOWED, int(w.statusCode))
+	}
+	if w.head {
+		// nothing is sent so there's nothing to buffer or chunk, just count it for Content-Length
+		w.bodyLen += int64(len(p))
+		return len(p), nil
+	}
+	if !w.committed {
+		if len(w.buf)+len(p) <= bufferLimit {
+			w.buf = append(w.buf, p...)
+			return len(p), nil
+		}
+		// too big to hold on to, send what we have and stream the rest
+		if err := w.commit(); err != nil {
+			return 0, err
+		}
+	}
+	return w.writeBody(p)
+}
+
+// Flush sends the status line, headers and whatever body has been written so far right away
+// if no length was set the body switches to chunked so the rest can keep streaming
+func (w *Writer) Flush() error {
+	if w.state == writeStatusState || w.state == writeHeadersState {
+		return fmt.Errorf("%w: Flush called while expecting %s", WRITE_OUT_OF_ORDER, w.state)
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if !w.committed {
+		if err := w.commit(); err != nil {
+			return err
+		}
+	}
+	// anything buffering in front of the connection (ex. bufio.Writer) needs a push too
+	if f, ok := w.w.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			w.err = err
+		}
+	}
+	return w.err
+}
+
+// Finish completes the response, sending anything still held back
+// a handler that wrote nothing gets an empty 200 and one that skipped the headers gets empty ones
+// the server calls this after the handler returns so handlers never need to
+func (w *Writer) Finish() error {
+	if w.state == writeDoneState {
+		return w.err
+	}
+	if w.failed != nil {
+		w.state = writeDoneState
+		return w.commit()
+	}
+	if w.state == writeStatusState {
+		w.WriteStatusLine(StatusCodeOk)
+	}
+	if w.state == writeHeadersState {
+		w.WriteHeaders(headers.NewHeaders())
+	}
+	w.state = writeDoneState
+	if !w.committed {
+		// we've seen the whole body by now so we know exactly how long it is
+		if w.headers.Get("content-length") == "" && !w.isChunked() && w.statusAllowsBody() {
+			bodyLen := int64(len(w.buf))
+			if w.head {
+				bodyLen = w.bodyLen
+			}
+			w.headers.Set("Content-Length", strconv.FormatInt(bodyLen, 10))
+		}
+		if err := w.commit(); err != nil {
+			return err
+		}
+	}
+	if w.chunked {
+		// zero length chunk with no trailers marks the end of the body
+		w.write([]byte("0\r\n\r\n"))
+	}
+	if w.declaredLen >= 0 && w.sentLen < w.declaredLen {
+		// the client is still waiting for the rest of the body, hanging up is the only way to tell it there's no more
+		w.closeConn = true
+	}
+	return w.err
+}
+
+// WriteText writes a complete plain text response in one go
+// handy for error responses that don't need any custom headers
+func (w *Writer) WriteText(statusCode StatusCode, msg string) error {
+	return w.WriteTextWithHeaders(statusCode, msg, GetDefaultHeaders(len(msg)))
+}
+
+// WriteTextWithHeaders is WriteText but lets the caller add to the default headers first
+func (w *Writer) WriteTextWithHeaders(statusCode StatusCode, msg string, h *headers.Headers) error {
+	if err := w.WriteStatusLine(statusCode); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+	_, err := w.WriteBody([]byte(msg))
+	return err
+}
+
+// swaps whatever the handler was putting together for an empty error response that Finish sends
+// the status comes from err if it has one (ex. the 500 on headers.BAD_HEADER_VALUE), otherwise it's a 500
+// err is returned as is so the handler still finds out, and every write after this gets it too
+func (w *Writer) fail(err error) error {
+	statusCode := StatusCodeISE
+	var se interface{ StatusCode() int }
+	if errors.As(err, &se) {
+		statusCode = StatusCode(se.StatusCode())
+	}
+	w.statusCode = statusCode
+	w.reason = statusCode.Reason()
+	w.headers = GetDefaultHeaders(0)
+	w.buf = nil
+	w.failed = err
+	return err
+}
+
+// sends the status line, headers and any held back body
+func (w *Writer) commit() error {
+	if w.statusAllowsBody() && w.headers.Get("content-length") == "" && w.version != "1.0" {
+		// length isn't known up front so each write goes out as its own chunk
+		w.headers.Set("Transfer-Encoding", "chunked")
+		// a HEAD response says how the body would be framed but never sends one, not even the last chunk
+		w.chunked = !w.head
+	}
+	if (!w.head && !w.bodyIsFramed()) || w.headers.HasToken("connection", "close") || w.expectContinue {
+		w.closeConn = true
+	}
+	if w.closeConn {
+		w.headers.Set("Connection", "close")
+	} else if w.version == "1.0" {
+		// persistent connections are opt-in for 1.0 so the client has to be told this one stays open
+		w.headers.Set("Connection", "keep-alive")
+	}
+	if w.defaults != nil {
+		for name, value := range w.defaults.All() {
+			if !w.headers.Has(name) {
+				w.headers.Add(name, value)
+			}
+		}
+	}
+	if w.statusAllowsBody() && !w.head {
+		if n, err := strconv.ParseInt(w.headers.Get("content-length"), 10, 64); err == nil && !w.isChunked() {
+			w.declaredLen = n
+		}
+	}
+	w.committed = true
+	if err := writeStatusLine(w.w, w.version, w.statusCode, w.reason); err != nil {
+		w.err = err
+		return err
+	}
+	if err := WriteHeaders(w.w, w.headers); err != nil {
+		w.err = err
+		return err
+	}
+	buf := w.buf
+	w.buf = nil
+	_, err := w.writeBody(buf)
+	return err
+}
+
+// writes p as body bytes, wrapping it up as a chunk if the body is chunked
+// with a Content-Length only what fits in it goes out, the rest is refused with BODY_TOO_LONG
+func (w *Writer) writeBody(p []byte) (int, error) {
+	if w.declaredLen >= 0 {
+		if left := w.declaredLen - w.sentLen; int64(len(p)) > left {
+			n, err := w.write(p[:left])
+			w.sentLen += int64(n)
+			if err != nil {
+				return n, err
+			}
+			return n, fmt.Errorf("%w: %d bytes over %d", BODY_TOO_LONG, int64(len(p))-left, w.declaredLen)
+		}
+		n, err := w.write(p)
+		w.sentLen += int64(n)
+		return n, err
+	}
+	if !w.chunked || len(p) == 0 {
+		// an empty chunk would end the body early so skip those
+		return w.write(p)
+	}
+	chunk := fmt.Appendf(nil, "%x\r\n", len(p))
+	chunk = append(chunk, p...)
+	chunk = append(chunk, CRLF...)
+	if _, err := w.write(chunk); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *Writer) write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := w.w.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// 1xx, 204 and 304 responses never have a body
+func (w *Writer) statusAllowsBody() bool {
+	return w.statusCode/100 != 1 && w.statusCode != 204 && w.statusCode != 304
+}
+
+func (w *Writer) isChunked() bool {
+	return w.headers.HasToken("transfer-encoding", "chunked")
+}
+
+// bodyIsFramed reports whether the client can find the end of the body without us closing the connection
+func (w *Writer) bodyIsFramed() bool {
+	return !w.statusAllowsBody() || w.headers.Get("content-length") != "" || w.isChunked()
+}
@@ -0,0 +1,326 @@
+package response
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sina.http/internal/headers"
+)
+
+func TestWriterOrdering(t *testing.T) {
+	// Test: headers before status line
+	w := NewWriter(&bytes.Buffer{})
+	assert.ErrorIs(t, w.WriteHeaders(headers.NewHeaders()), WRITE_OUT_OF_ORDER)
+
+	// Test: status line twice
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(200))
+	assert.ErrorIs(t, w.WriteStatusLine(404), WRITE_OUT_OF_ORDER)
+
+	// Test: body after status line but without headers
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(200))
+	_, err := w.WriteBody([]byte("hi"))
+	assert.ErrorIs(t, err, WRITE_OUT_OF_ORDER)
+
+	// Test: anything after Finish
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.Finish())
+	_, err = w.WriteBody([]byte("hi"))
+	assert.ErrorIs(t, err, WRITE_AFTER_FINISH)
+}
+
+func TestWriterImplicitStatusAndLength(t *testing.T) {
+	// Test: body with nothing else written gets a 200 and a Content-Length once finished
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	_, err := w.WriteBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte("world"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, buf.Len(), "small bodies are held back until Finish")
+	require.NoError(t, w.Finish())
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "Content-Length: 11\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello world"))
+	assert.False(t, w.WillClose())
+
+	// Test: handler that writes nothing at all gets an empty 200
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, buf.String(), "Content-Length: 0\r\n")
+
+	// Test: known length goes out right away
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(404))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(3)))
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 404 Not Found\r\n"))
+}
+
+func TestWriterChunked(t *testing.T) {
+	// Test: a body too big to hold back is streamed as chunks and the connection can stay open
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	big := bytes.Repeat([]byte("a"), bufferLimit+1)
+	_, err := w.WriteBody(big)
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	out := buf.String()
+	assert.NotContains(t, strings.ToLower(out), "content-length")
+	assert.Contains(t, out, "Transfer-Encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n1001\r\n"+string(big)+"\r\n0\r\n\r\n"))
+	assert.False(t, w.WillClose())
+
+	// Test: Flush sends what's been written so far as a chunk right away
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(200))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	assert.Equal(t, 0, buf.Len())
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n5\r\nhello\r\n"))
+	_, err = w.WriteBody([]byte(" world!"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(buf.String(), "5\r\nhello\r\n7\r\n world!\r\n"))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "7\r\n world!\r\n0\r\n\r\n"))
+
+	// Test: Flush before any headers is out of order
+	w = NewWriter(&bytes.Buffer{})
+	assert.ErrorIs(t, w.Flush(), WRITE_OUT_OF_ORDER)
+}
+
+func TestWriterHeaderSafety(t *testing.T) {
+	// Test: names go out spelled the way they were set, in the order they were set
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	h := GetDefaultHeaders(2)
+	h.Add("x-trace-id", "abc")
+	h.Add("ETag", `"v1"`)
+	h.Add("WWW-Authenticate", "Basic")
+	h.Add("Set-Cookie", "a=1")
+	h.Add("Set-Cookie", "b=2")
+	require.NoError(t, w.WriteStatusLine(200))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteBody([]byte("hi"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nContent-Type: text/plain\r\nx-trace-id: abc\r\nETag: \"v1\"\r\nWWW-Authenticate: Basic\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2\r\n\r\nhi", buf.String())
+
+	// Test: a value with CRLF in it is rejected and nothing goes out
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	h = GetDefaultHeaders(0)
+	h.Set("Location", "/home\r\nSet-Cookie: evil=1")
+	require.NoError(t, w.WriteStatusLine(302))
+	assert.ErrorIs(t, w.WriteHeaders(h), headers.BAD_HEADER_VALUE)
+	assert.Equal(t, 0, buf.Len())
+
+	// Test: and the response becomes a 500 instead of whatever the handler goes on to write
+	_, err = w.WriteBody([]byte("hi"))
+	assert.ErrorIs(t, err, headers.BAD_HEADER_VALUE)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 500 Internal Server Error\r\n"))
+	assert.Contains(t, buf.String(), "Content-Length: 0\r\n")
+	assert.NotContains(t, buf.String(), "evil")
+	assert.NotContains(t, buf.String(), "hi")
+	assert.False(t, w.WillClose())
+
+	// Test: same goes for WriteHeaders on its own
+	buf = &bytes.Buffer{}
+	h = headers.NewHeaders()
+	h.Set("X-Ok", "fine")
+	h.Set("X-Bad", "nul\x00")
+	assert.ErrorIs(t, WriteHeaders(buf, h), headers.BAD_HEADER_VALUE)
+	assert.Equal(t, 0, buf.Len())
+}
+
+func TestWriterDefaultHeaders(t *testing.T) {
+	// Test: defaults go out after the handler's headers
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetDefaultHeader("Date", "Sun, 06 Nov 1994 08:49:37 GMT")
+	w.SetDefaultHeader("Server", "test")
+	require.NoError(t, w.WriteText(200, "hi"))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Content-Type: text/plain\r\nDate: Sun, 06 Nov 1994 08:49:37 GMT\r\nServer: test\r\n\r\nhi")
+
+	// Test: a header the handler set wins over the default
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetDefaultHeader("Server", "test")
+	h := GetDefaultHeaders(0)
+	h.Set("server", "custom")
+	require.NoError(t, w.WriteStatusLine(204))
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "server: custom\r\n")
+	assert.NotContains(t, buf.String(), "test")
+
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:37 GMT", FormatDate(time.Date(1994, 11, 6, 3, 49, 37, 0, time.FixedZone("EST", -5*3600))))
+}
+
+func TestWriterHTTP10(t *testing.T) {
+	// Test: small bodies still get a Content-Length, and a kept-alive 1.0 connection is announced
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetVersion("1.0")
+	require.NoError(t, w.WriteText(200, "hi"))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.0 200 OK\r\n"))
+	assert.Contains(t, buf.String(), "Content-Length: 2\r\n")
+	assert.Contains(t, buf.String(), "Connection: keep-alive\r\n")
+	assert.False(t, w.WillClose())
+
+	// Test: no chunked for 1.0, the body ends when the connection closes instead
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetVersion("1.0")
+	big := bytes.Repeat([]byte("a"), bufferLimit+1)
+	_, err := w.WriteBody(big)
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	out := buf.String()
+	assert.NotContains(t, out, "Transfer-Encoding")
+	assert.NotContains(t, out, "Content-Length")
+	assert.Contains(t, out, "Connection: close\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"+string(big)))
+	assert.True(t, w.WillClose())
+}
+
+func TestWriterInformational(t *testing.T) {
+	// Test: 103 Early Hints goes out right away and the final response follows it
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	h := headers.NewHeaders()
+	h.Add("Link", "</style.css>; rel=preload; as=style")
+	h.Add("Link", "</script.js>; rel=preload; as=script")
+	require.NoError(t, w.WriteInformational(StatusCodeEarlyHints, h))
+	assert.Equal(t, "HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload; as=style\r\nLink: </script.js>; rel=preload; as=script\r\n\r\n", buf.String())
+	require.NoError(t, w.WriteText(200, "ok"))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buf.String()[strings.Index(buf.String(), "\r\n\r\n")+4:], "HTTP/1.1 200 OK\r\n"))
+
+	// Test: only 1xx (but not 101), and only before the final response
+	w = NewWriter(&bytes.Buffer{})
+	assert.ErrorIs(t, w.WriteInformational(200, nil), NOT_INFORMATIONAL)
+	assert.ErrorIs(t, w.WriteInformational(StatusCodeSwitchingProtocols, nil), NOT_INFORMATIONAL)
+	require.NoError(t, w.WriteStatusLine(200))
+	assert.ErrorIs(t, w.WriteInformational(StatusCodeEarlyHints, nil), WRITE_OUT_OF_ORDER)
+
+	// Test: 1.0 clients never see them
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetVersion("1.0")
+	require.NoError(t, w.WriteInformational(StatusCodeEarlyHints, nil))
+	assert.Equal(t, 0, buf.Len())
+
+	// Test: 100 Continue is sent once and only while it's expected
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteContinue())
+	assert.Equal(t, 0, buf.Len())
+	w.SetExpectContinue()
+	require.NoError(t, w.WriteContinue())
+	require.NoError(t, w.WriteContinue())
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", buf.String())
+	require.NoError(t, w.WriteText(200, "ok"))
+	require.NoError(t, w.Finish())
+	assert.False(t, w.WillClose())
+
+	// Test: final response without the 100 has to close the connection
+	w = NewWriter(&bytes.Buffer{})
+	w.SetExpectContinue()
+	require.NoError(t, w.WriteText(StatusCodeExpectationFailed, "no"))
+	require.NoError(t, w.Finish())
+	assert.True(t, w.WillClose())
+}
+
+func TestWriterHead(t *testing.T) {
+	// Test: small body is dropped but its length is kept
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetHead()
+	require.NoError(t, w.WriteText(200, "hello"))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Content-Length: 5\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n"))
+	assert.False(t, w.WillClose())
+
+	// Test: a body too big to buffer still gets its full Content-Length instead of chunked
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetHead()
+	_, err := w.WriteBody(bytes.Repeat([]byte("a"), bufferLimit*3))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Content-Length: 12288\r\n")
+	assert.NotContains(t, buf.String(), "Transfer-Encoding")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n"))
+
+	// Test: flushed HEAD says it would be chunked but sends no chunks and keeps the connection
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetHead()
+	require.NoError(t, w.WriteStatusLine(200))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Transfer-Encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n"))
+	assert.NotContains(t, buf.String(), "hello")
+	assert.False(t, w.WillClose())
+}
+
+func TestWriterKeepsToFraming(t *testing.T) {
+	// Test: nothing past the Content-Length goes out, the extra would look like the next response
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(200))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(2)))
+	n, err := w.WriteBody([]byte("hiHTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nevil"))
+	assert.ErrorIs(t, err, BODY_TOO_LONG)
+	assert.Equal(t, 2, n)
+	_, err = w.WriteBody([]byte("more"))
+	assert.ErrorIs(t, err, BODY_TOO_LONG)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhi"))
+	assert.False(t, w.WillClose())
+
+	// Test: finishing short of the Content-Length means the connection has to close
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(200))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err = w.WriteBody([]byte("hi"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, w.WillClose())
+
+	// Test: 204 and 304 refuse a body, an empty write is still fine
+	for _, code := range []StatusCode{204, 304} {
+		buf = &bytes.Buffer{}
+		w = NewWriter(buf)
+		require.NoError(t, w.WriteStatusLine(code))
+		require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+		_, err = w.WriteBody([]byte("oops"))
+		assert.ErrorIs(t, err, BODY_NOT_ALLOWED)
+		_, err = w.WriteBody(nil)
+		assert.NoError(t, err)
+		require.NoError(t, w.Finish())
+		assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n"))
+		assert.False(t, w.WillClose())
+	}
+}
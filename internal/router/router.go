@@ -0,0 +1,233 @@
+package router
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"sina.http/internal/request"
+	"sina.http/internal/response"
+	"sina.http/internal/server"
+)
+
+// kinds of segments a route pattern can be split into
+const (
+	literalSeg  = "literal"
+	paramSeg    = "param"    // {name} matches exactly one path segment
+	wildcardSeg = "wildcard" // *name matches the rest of the path, only allowed as the last segment
+)
+
+type segment struct {
+	kind  string
+	value string // literal text or the param/wildcard name
+}
+
+type route struct {
+	pattern  string
+	segments []segment
+	methods  []string // empty means any method
+	handler  server.Handler
+}
+
+// Router picks a handler based on the request method and target
+// routes are tried in the order they were registered and the first one that matches wins
+type Router struct {
+	// pointer so routers made by With register into the same table
+	routes      *[]*route
+	middlewares []server.Middleware
+}
+
+func NewRouter() *Router {
+	return &Router{routes: &[]*route{}}
+}
+
+// Use adds middleware to every route registered on this router afterwards
+func (rt *Router) Use(mws ...server.Middleware) {
+	rt.middlewares = append(rt.middlewares, mws...)
+}
+
+// With returns a router that shares rt's routes but wraps anything registered through it with mws as well
+// ex. rt.With(requireAuth).Get("/admin", adminHandler)
+func (rt *Router) With(mws ...server.Middleware) *Router {
+	return &Router{
+		routes:      rt.routes,
+		middlewares: append(slices.Clone(rt.middlewares), mws...),
+	}
+}
+
+// Handle registers handler for pattern, only for the given methods (or every method if none are passed)
+// patterns look like /users/{id} or /static/*rest, panics if the pattern is malformed since that's a programming error
+func (rt *Router) Handle(pattern string, handler server.Handler, methods ...string) {
+	segs, err := parsePattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+	*rt.routes = append(*rt.routes, &route{
+		pattern:  pattern,
+		segments: segs,
+		methods:  methods,
+		handler:  server.Chain(handler, rt.middlewares...),
+	})
+}
+
+func (rt *Router) Get(pattern string, handler server.Handler) {
+	rt.Handle(pattern, handler, "GET")
+}
+
+func (rt *Router) Post(pattern string, handler server.Handler) {
+	rt.Handle(pattern, handler, "POST")
+}
+
+func (rt *Router) Put(pattern string, handler server.Handler) {
+	rt.Handle(pattern, handler, "PUT")
+}
+
+func (rt *Router) Delete(pattern string, handler server.Handler) {
+	rt.Handle(pattern, handler, "DELETE")
+}
+
+// ServeRequest has the server.Handler signature so the router itself can be passed to server.Serve
+// replies 404 if no route matches the path and 405 if one does but not for this method
+// HEAD falls back to the GET route for the path (the server drops the body) and OPTIONS is answered
+// with the Allow list unless a route handles it itself, OPTIONS * lists every method the router knows
+// (the standard methods if some route takes any method)
+func (rt *Router) ServeRequest(w *response.Writer, req *request.Request) {
+	method := req.RequestLine.Method
+	if method == "OPTIONS" && req.URL.Form == request.AsteriskForm {
+		var all []string
+		for _, r := range *rt.routes {
+			if len(r.methods) == 0 {
+				all = standardMethods
+				break
+			}
+			all = append(all, r.methods...)
+		}
+		writeOptions(w, all)
+		return
+	}
+
+	var allowed []string
+	var headRoute *route
+	var headParams map[string]string
+	for _, r := range *rt.routes {
+		params, ok := r.match(req.URL.Path)
+		if !ok {
+			continue
+		}
+		if len(r.methods) == 0 || slices.Contains(r.methods, method) {
+			req.PathParams = params
+			r.handler(w, req)
+			return
+		}
+		if method == "HEAD" && headRoute == nil && slices.Contains(r.methods, "GET") {
+			// only used if no route handles HEAD itself
+			headRoute, headParams = r, params
+		}
+		allowed = append(allowed, r.methods...)
+	}
+
+	switch {
+	case headRoute != nil:
+		req.PathParams = headParams
+		headRoute.handler(w, req)
+	case len(allowed) == 0:
+		w.WriteText(response.StatusCodeNotFound, "Not Found\r\n")
+	case method == "OPTIONS":
+		writeOptions(w, allowed)
+	default:
+		msg := "Method Not Allowed\r\n"
+		h := response.GetDefaultHeaders(len(msg))
+		h.Set("Allow", allowHeader(allowed))
+		w.WriteTextWithHeaders(response.StatusCodeMethodNotAllowed, msg, h)
+	}
+}
+
+// the methods defined in RFC 9110 section 9 plus PATCH, what a route without a method list is taken to accept
+var standardMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"}
+
+// empty 200 with the Allow list
+func writeOptions(w *response.Writer, methods []string) {
+	h := response.GetDefaultHeaders(0)
+	h.Set("Allow", allowHeader(methods))
+	w.WriteTextWithHeaders(response.StatusCodeOk, "", h)
+}
+
+// sorted, deduplicated methods for an Allow header
+// GET implies HEAD since HEAD falls back to it, and OPTIONS is always answered
+func allowHeader(methods []string) string {
+	methods = append(slices.Clone(methods), "OPTIONS")
+	if slices.Contains(methods, "GET") {
+		methods = append(methods, "HEAD")
+	}
+	slices.Sort(methods)
+	return strings.Join(slices.Compact(methods), ", ")
+}
+
+func parsePattern(pattern string) ([]segment, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("route pattern %q must start with /", pattern)
+	}
+	parts := strings.Split(pattern[1:], "/")
+	segs := make([]segment, 0, len(parts))
+	for i, part := range parts {
+		switch {
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			name := part[1 : len(part)-1]
+			if name == "" {
+				return nil, fmt.Errorf("route pattern %q has an unnamed parameter", pattern)
+			}
+			segs = append(segs, segment{kind: paramSeg, value: name})
+		case strings.HasPrefix(part, "*"):
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("route pattern %q has a wildcard that isn't the last segment", pattern)
+			}
+			segs = append(segs, segment{kind: wildcardSeg, value: part[1:]})
+		default:
+			segs = append(segs, segment{kind: literalSeg, value: part})
+		}
+	}
+	return segs, nil
+}
+
+// match checks path against the route's segments and returns the captured params if it matches
+// path is still percent-encoded, params come back decoded (an encoded / never gets this far, NormalizePath refuses it)
+func (r *route) match(path string) (map[string]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	parts := strings.Split(path[1:], "/")
+	params := map[string]string{}
+	for i, seg := range r.segments {
+		if seg.kind == wildcardSeg {
+			// wildcard soaks up everything left, including nothing at all
+			if seg.value != "" {
+				rest, err := url.PathUnescape(strings.Join(parts[i:], "/"))
+				if err != nil {
+					return nil, false
+				}
+				params[seg.value] = rest
+			}
+			return params, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		switch seg.kind {
+		case literalSeg:
+			if parts[i] != seg.value {
+				return nil, false
+			}
+		case paramSeg:
+			val, err := url.PathUnescape(parts[i])
+			if parts[i] == "" || err != nil {
+				return nil, false
+			}
+			params[seg.value] = val
+		}
+	}
+	if len(parts) != len(r.segments) {
+		return nil, false
+	}
+	return params, true
+}
@@ -0,0 +1,167 @@
+package router
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sina.http/internal/request"
+	"sina.http/internal/response"
+	"sina.http/internal/server"
+)
+
+// builds a request for method+target, runs it through the router and returns the raw response
+func serve(t *testing.T, rt *Router, method, target string) string {
+	raw := method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	rt.ServeRequest(response.NewWriter(buf), req)
+	return buf.String()
+}
+
+func textHandler(msg string) func(w *response.Writer, req *request.Request) {
+	return func(w *response.Writer, req *request.Request) {
+		w.WriteText(200, msg)
+	}
+}
+
+func TestRouterMatching(t *testing.T) {
+	rt := NewRouter()
+	var gotID, gotRest string
+	rt.Get("/users/{id}", func(w *response.Writer, req *request.Request) {
+		gotID = req.PathParam("id")
+		w.WriteText(200, "user")
+	})
+	rt.Get("/static/*rest", func(w *response.Writer, req *request.Request) {
+		gotRest = req.PathParam("rest")
+		w.WriteText(200, "static")
+	})
+	rt.Handle("/any", textHandler("any"))
+
+	// Test: path param gets captured, query string ignored
+	out := serve(t, rt, "GET", "/users/42?verbose=1")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, "42", gotID)
+
+	// Test: wildcard captures the rest of the path
+	out = serve(t, rt, "GET", "/static/css/site.css")
+	assert.True(t, strings.HasSuffix(out, "static"))
+	assert.Equal(t, "css/site.css", gotRest)
+
+	// Test: captured params come out percent-decoded
+	serve(t, rt, "GET", "/users/a%20b")
+	assert.Equal(t, "a b", gotID)
+	serve(t, rt, "GET", "/static/my%20dir/caf%C3%A9.css")
+	assert.Equal(t, "my dir/café.css", gotRest)
+
+	// Test: route with no methods matches every method
+	out = serve(t, rt, "PATCH", "/any")
+	assert.True(t, strings.HasSuffix(out, "any"))
+
+	// Test: param segment can't be empty or span segments
+	out = serve(t, rt, "GET", "/users/")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+	out = serve(t, rt, "GET", "/users/42/posts")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	rt := NewRouter()
+	rt.Get("/items/{id}", textHandler("get"))
+	rt.Delete("/items/{id}", textHandler("delete"))
+	rt.Handle("/items/{id}", textHandler("put"), "PUT", "GET")
+
+	out := serve(t, rt, "DELETE", "/items/1")
+	assert.True(t, strings.HasSuffix(out, "delete"))
+
+	out = serve(t, rt, "POST", "/items/1")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, out, "Allow: DELETE, GET, HEAD, OPTIONS, PUT\r\n")
+}
+
+func TestBadPatternPanics(t *testing.T) {
+	rt := NewRouter()
+	assert.Panics(t, func() { rt.Get("/files/*rest/more", textHandler("")) })
+	assert.Panics(t, func() { rt.Get("no-slash", textHandler("")) })
+	assert.Panics(t, func() { rt.Get("/users/{}", textHandler("")) })
+}
+
+func TestRouteMiddleware(t *testing.T) {
+	var calls []string
+	tag := func(name string) server.Middleware {
+		return func(next server.Handler) server.Handler {
+			return func(w *response.Writer, req *request.Request) {
+				calls = append(calls, name)
+				next(w, req)
+			}
+		}
+	}
+	rt := NewRouter()
+	rt.Use(tag("global"))
+	rt.With(tag("admin")).Get("/admin", textHandler("admin"))
+	rt.Get("/public", textHandler("public"))
+
+	serve(t, rt, "GET", "/admin")
+	assert.Equal(t, []string{"global", "admin"}, calls)
+
+	calls = nil
+	out := serve(t, rt, "GET", "/public")
+	assert.True(t, strings.HasSuffix(out, "public"))
+	assert.Equal(t, []string{"global"}, calls)
+}
+
+func TestHeadAndOptions(t *testing.T) {
+	rt := NewRouter()
+	var gotID string
+	rt.Get("/items/{id}", func(w *response.Writer, req *request.Request) {
+		gotID = req.PathParam("id")
+		w.WriteText(200, "item")
+	})
+	rt.Post("/items/{id}", textHandler("post"))
+	rt.Handle("/custom", textHandler("custom head"), "HEAD")
+	rt.Get("/custom", textHandler("custom get"))
+	rt.Handle("/cors", textHandler("own options"), "OPTIONS")
+	rt.Delete("/other", textHandler("delete"))
+
+	// Test: HEAD falls back to the GET route with params
+	out := serve(t, rt, "HEAD", "/items/7")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, "7", gotID)
+
+	// Test: a route registered for HEAD wins over the GET fallback
+	out = serve(t, rt, "HEAD", "/custom")
+	assert.True(t, strings.HasSuffix(out, "custom head"))
+
+	// Test: HEAD without a GET route is still a 405
+	out = serve(t, rt, "HEAD", "/other")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, out, "Allow: DELETE, OPTIONS\r\n")
+
+	// Test: OPTIONS gets the methods for that path
+	out = serve(t, rt, "OPTIONS", "/items/7")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "Allow: GET, HEAD, OPTIONS, POST\r\n")
+	assert.Contains(t, out, "Content-Length: 0\r\n")
+
+	// Test: routes can still handle OPTIONS themselves, and unknown paths are a 404
+	out = serve(t, rt, "OPTIONS", "/cors")
+	assert.True(t, strings.HasSuffix(out, "own options"))
+	out = serve(t, rt, "OPTIONS", "/nope")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: OPTIONS * lists everything the router knows
+	out = serve(t, rt, "OPTIONS", "*")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "Allow: DELETE, GET, HEAD, OPTIONS, POST\r\n")
+
+	// Test: OPTIONS * with an any-method route lists the standard methods
+	rt = NewRouter()
+	rt.Handle("/any", textHandler("any"))
+	rt.Get("/g", textHandler("g"))
+	out = serve(t, rt, "OPTIONS", "*")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "Allow: CONNECT, DELETE, GET, HEAD, OPTIONS, PATCH, POST, PUT, TRACE\r\n")
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"sina.http/internal/request"
+	"sina.http/internal/response"
+)
+
+// Middleware wraps a Handler to add behavior before and/or after it runs (logging, auth, etc.)
+// it can also decide not to call next at all and write its own response instead
+type Middleware func(next Handler) Handler
+
+// Chain wraps h with mws so that mws[0] is the outermost layer and runs first
+func Chain(h Handler, mws ...Middleware) Handler {
+	// wrap from the inside out so the first middleware ends up on the outside
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// LogRequests logs the method, target and how long the rest of the chain took for every request
+func LogRequests(next Handler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		start := time.Now()
+		next(w, req)
+		log.Printf("%s %s (%v)", req.RequestLine.Method, req.RequestLine.RequestTarget, time.Since(start))
+	}
+}
+
+// RedirectCanonicalPath redirects requests whose path isn't in normalized form (see request.NormalizePath) to the normalized one
+// ex. GET /a//b/../c gets a 301 to /c, other methods get a 308 so the client repeats the same method and body
+// without it handlers just see the normalized path in req.URL.Path
+func RedirectCanonicalPath(next Handler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		if req.URL == nil || req.URL.Path == req.URL.RawPath {
+			next(w, req)
+			return
+		}
+		location := req.URL.Path
+		if req.URL.RawQuery != "" {
+			location += "?" + req.URL.RawQuery
+		}
+		status := response.StatusCodePermanentRedirect
+		if req.RequestLine.Method == "GET" || req.RequestLine.Method == "HEAD" {
+			status = response.StatusCodeMovedPermanently
+		}
+		msg := "Redirecting to " + location + "\r\n"
+		h := response.GetDefaultHeaders(len(msg))
+		h.Set("Location", location)
+		w.WriteTextWithHeaders(status, msg, h)
+	}
+}
@@ -1,69 +1,431 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
+	"runtime/debug"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"sina.http/internal/request"
 	"sina.http/internal/response"
 )
 
+// Handler gets called once per parsed request and is responsible for writing the full response through w
+type Handler func(w *response.Writer, req *request.Request)
+
 // bind+listen to a port -> in a loop accept connections and handle each in a goroutine -> do until closed
 type Server struct {
-	closed   atomic.Bool
-	listener net.Listener
+	closed      atomic.Bool
+	listener    net.Listener
+	handler     Handler
+	middlewares []Middleware
+
+	// ErrorLog gets called with errors that happen outside of a handler (accepting connections, writing error responses...)
+	// and with recovered panics along with their stack trace
+	// defaults to logging them with the standard logger
+	ErrorLog func(err error)
+
+	// connection timeouts, zero means no timeout
+	ReadHeaderTimeout time.Duration // time to read the request line + headers, falls back to ReadTimeout if zero
+	ReadTimeout       time.Duration // time to read the entire request including the body
+	WriteTimeout      time.Duration // time from the end of reading the request to the end of writing the response
+	IdleTimeout       time.Duration // time to wait for the next request on a keep-alive connection, falls back to ReadTimeout if zero
+
+	// size limits on incoming requests, zero fields use request.DefaultLimits
+	// the body isn't limited by default since handlers get it as a stream, set MaxBodySize if a handler buffers it
+	Limits request.Limits
+
+	// value of the Server header sent with every response, New sets it to DefaultServerHeader and "" leaves it out
+	// handlers can still set their own Server header to override it
+	ServerHeader string
+
+	date dateCache
+
+	mu    sync.Mutex
+	conns map[net.Conn]string // every open connection -> connection state, so Shutdown knows what it's waiting on
 }
 
-func newServer(listener net.Listener) *Server {
-	srv := &Server{closed: atomic.Bool{}, listener: listener}
-	return srv
+// connection states, a conn is active while a request is being read/handled and idle while waiting for the next one
+const (
+	stateActive = "active"
+	stateIdle   = "idle"
+)
+
+// DefaultServerHeader is what New sets ServerHeader to
+const DefaultServerHeader = "sina.http"
+
+// how often Shutdown checks whether all connections have finished
+const shutdownPollInterval = 10 * time.Millisecond
+
+// backoff bounds for retrying Accept after a temporary error like running out of file descriptors
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// New makes a Server that isn't listening yet so it can be configured (ex. with Use) before calling Listen
+func New(handler Handler) *Server {
+	return &Server{closed: atomic.Bool{}, handler: handler, ServerHeader: DefaultServerHeader}
 }
 
 // Sets up a listener at specified port
 // Returns a new Server and sets that server to listen in a separate goroutine
-func Serve(port uint16) (*Server, error) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
+// every request that comes in on a connection gets parsed and passed to handler
+func Serve(port uint16, handler Handler) (*Server, error) {
+	srv := New(handler)
+	if err := srv.Listen(port); err != nil {
 		return nil, err
 	}
-	srv := newServer(listener)
-	go srv.listen()
 	return srv, nil
 }
 
-// Sets closed to true and closes the server's listener binded to its port
+// Listen binds to port and starts accepting connections in a separate goroutine
+func (s *Server) Listen(port uint16) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	go s.listen()
+	return nil
+}
+
+// Use adds middleware that every request passes through before reaching the handler
+// middleware runs in the order it was added, must be called before Listen
+func (s *Server) Use(mws ...Middleware) {
+	s.middlewares = append(s.middlewares, mws...)
+}
+
+// Addr is the address the server is listening on, useful when Listen was given port 0
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Sets closed to true, closes the server's listener binded to its port and drops every open connection
+// use Shutdown instead to let in-flight requests finish
 func (s *Server) Close() error {
 	s.closed.Store(true)
 	err := s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
 	return err
 }
 
+// Shutdown stops accepting new connections then waits for active ones to finish, closing idle ones as it goes
+// if ctx is done before that, whatever is left gets force closed and ctx's error is returned
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closed.Store(true)
+	err := s.listener.Close()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closes every idle connection and returns how many connections are still open
+func (s *Server) closeIdleConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, state := range s.conns {
+		if state == stateIdle {
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return len(s.conns)
+}
+
+// records conn's current state, returns false if the server is closing and conn shouldn't be served any further
+// a connection that's already being tracked can still go active during shutdown so a request that made it in gets answered
+func (s *Server) trackConn(conn net.Conn, state string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, tracked := s.conns[conn]
+	if s.closed.Load() && (!tracked || state == stateIdle) {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]string)
+	}
+	s.conns[conn] = state
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+func (s *Server) logError(err error) {
+	if s.ErrorLog != nil {
+		s.ErrorLog(err)
+		return
+	}
+	log.Printf("server error: %v", err)
+}
+
+// reports whether an Accept error is worth retrying (ex. EMFILE when we're out of file descriptors)
+func isTemporary(err error) bool {
+	var te interface{ Temporary() bool }
+	return errors.As(err, &te) && te.Temporary()
+}
+
 func (s *Server) listen() {
+	var backoff time.Duration
 	for s.closed.Load() != true {
 		conn, err := s.listener.Accept()
-
-		// TODO: May need to change this to a 500 internal server error or something
 		if err != nil {
-			log.Fatalf("Server could not accept incoming connection, see error:\n%v ", err)
+			if s.closed.Load() || errors.Is(err, net.ErrClosed) {
+				return // listener was closed on purpose by Close/Shutdown
+			}
+			if !isTemporary(err) {
+				s.logError(fmt.Errorf("stopped accepting connections: %w", err))
+				return
+			}
+			// back off exponentially so we don't spin while e.g. the fd table is full
+			backoff = min(max(2*backoff, minAcceptBackoff), maxAcceptBackoff)
+			s.logError(fmt.Errorf("accept error, retrying in %v: %w", backoff, err))
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		// nothing has been sent on it yet so it counts as idle until a request starts arriving
+		if !s.trackConn(conn, stateIdle) {
+			conn.Close()
+			continue
 		}
 		go s.handle(conn)
 	}
 }
 
-func (s *Server) handle(conn io.ReadWriteCloser) {
-	statusCode := 200
-	content := "Hello World\r\n"
-	h := response.GetDefaultHeaders(len(content))
-	// write status line then headers, then content
-	err := response.WriteStatusLine(conn, statusCode)
-	err = response.WriteHeaders(conn, h)
-	_, err = conn.Write([]byte(content))
-	if err != nil {
-		log.Fatalf("error occurred while handling server connection: %v", err)
+// turns a timeout into an absolute deadline for net.Conn, zero timeout -> zero time which means no deadline
+func deadline(start time.Time, timeout time.Duration) time.Time {
+	if timeout == 0 {
+		return time.Time{}
+	}
+	return start.Add(timeout)
+}
+
+func (s *Server) readHeaderTimeout() time.Duration {
+	if s.ReadHeaderTimeout != 0 {
+		return s.ReadHeaderTimeout
+	}
+	return s.ReadTimeout
+}
+
+func (s *Server) idleTimeout() time.Duration {
+	if s.IdleTimeout != 0 {
+		return s.IdleTimeout
+	}
+	return s.ReadTimeout
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// implemented by the parse errors in the request and headers packages
+type statusError interface {
+	error
+	StatusCode() int
+}
+
+// answers a request we couldn't read then the connection gets closed
+// 408 if the client was too slow, whatever status a typed parse error asks for, or 400 for anything else
+func (s *Server) writeReadError(conn net.Conn, err error) {
+	statusCode := response.StatusCodeBadReq
+	msg := err.Error()
+	var se statusError
+	if isTimeout(err) {
+		statusCode = response.StatusCodeRequestTimeout
+		msg = "request timed out"
+	} else if errors.As(err, &se) {
+		statusCode = response.StatusCode(se.StatusCode())
+		msg = se.Error()
+	}
+	s.writeErrorResponse(conn, statusCode, msg)
+}
+
+// writes a plain text error response with Connection: close, the caller hangs up after
+func (s *Server) writeErrorResponse(conn net.Conn, statusCode response.StatusCode, msg string) {
+	// the old write deadline may be left over from the previous request on this connection
+	conn.SetWriteDeadline(deadline(time.Now(), s.WriteTimeout))
+	w := s.newWriter(conn)
+	w.SetClose()
+	w.WriteText(statusCode, msg+"\r\n")
+	if err := w.Finish(); err != nil {
+		s.logError(fmt.Errorf("error writing %d response: %w", statusCode, err))
+	}
+}
+
+// recovers a panic anywhere in serving conn (the handler, middleware or our own parsing) so it only takes down this connection
+// the stack goes to ErrorLog, and the client gets a 500 unless part of the response (w) is already on the wire
+// in which case the best we can do is hang up so the client sees it was cut short
+func (s *Server) recoverConn(conn net.Conn, w **response.Writer) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	s.logError(fmt.Errorf("panic serving %v: %v\n%s", conn.RemoteAddr(), p, debug.Stack()))
+	if *w == nil || !(*w).Committed() {
+		s.writeErrorResponse(conn, response.StatusCodeISE, "Internal Server Error")
+	}
+}
+
+// continueBody sends 100 Continue the first time the handler reads the body of an Expect: 100-continue request
+type continueBody struct {
+	io.ReadCloser
+	w    *response.Writer
+	sent bool
+}
+
+func (b *continueBody) Read(p []byte) (int, error) {
+	if !b.sent {
+		b.sent = true
+		if err := b.w.WriteContinue(); err != nil {
+			return 0, err
+		}
+	}
+	return b.ReadCloser.Read(p)
+}
+
+// makes the writer for a response on conn with the headers every response should carry
+func (s *Server) newWriter(conn net.Conn) *response.Writer {
+	w := response.NewWriter(conn)
+	w.SetDefaultHeader("Date", s.date.get(time.Now()))
+	if s.ServerHeader != "" {
+		w.SetDefaultHeader("Server", s.ServerHeader)
+	}
+	return w
+}
+
+// dateCache holds the formatted Date header for the current second so it isn't formatted again for every response
+type dateCache struct {
+	cur atomic.Pointer[cachedDate]
+}
+
+type cachedDate struct {
+	unix  int64
+	value string
+}
+
+func (c *dateCache) get(now time.Time) string {
+	if d := c.cur.Load(); d != nil && d.unix == now.Unix() {
+		return d.value
+	}
+	d := &cachedDate{unix: now.Unix(), value: response.FormatDate(now)}
+	c.cur.Store(d)
+	return d.value
+}
+
+// serves requests off conn one after another (keep-alive) until either side wants to close
+// pipelined requests are answered in the order they came in since we only read the next one after responding
+func (s *Server) handle(conn net.Conn) {
+	defer s.untrackConn(conn)
+	defer conn.Close()
+	// writer for the response in progress, nil while reading the next request
+	var w *response.Writer
+	// has to be deferred directly for recover to work, &w so it sees whichever writer is current when the panic happens
+	defer s.recoverConn(conn, &w)
+	rr := request.NewReaderWithLimits(conn, s.Limits)
+	for first := true; ; first = false {
+		w = nil
+		waitStart := time.Now()
+		if rr.Buffered() == 0 {
+			// wait for the next request to start, if it never comes just hang up
+			// the first one gets ReadHeaderTimeout from when we accepted, later ones the idle timeout
+			timeout := s.idleTimeout()
+			if first {
+				timeout = s.readHeaderTimeout()
+			}
+			conn.SetReadDeadline(deadline(time.Now(), timeout))
+			if err := rr.Fill(); err != nil {
+				return
+			}
+		}
+		// a request has started arriving so Shutdown has to wait for it instead of closing the connection under it
+		if !s.trackConn(conn, stateActive) {
+			return
+		}
+
+		readStart := time.Now()
+		if first {
+			readStart = waitStart // ReadHeaderTimeout for the first request already started counting before Fill
+		}
+		conn.SetReadDeadline(deadline(readStart, s.readHeaderTimeout()))
+		req, err := rr.ReadRequest()
+		if err == io.EOF {
+			return // client hung up between requests
+		}
+		if err != nil {
+			// couldn't make sense of what the client sent (or they were too slow) so tell them and hang up
+			s.writeReadError(conn, err)
+			return
+		}
+		// the handler streams the body off the connection so ReadTimeout has to cover the handler's reads
+		conn.SetReadDeadline(deadline(readStart, s.ReadTimeout))
+		conn.SetWriteDeadline(deadline(time.Now(), s.WriteTimeout))
+
+		w = s.newWriter(conn)
+		w.SetVersion(req.RequestLine.HttpVersion)
+		if !req.KeepAlive() || s.closed.Load() {
+			w.SetClose()
+		}
+		if req.RequestLine.Method == "HEAD" {
+			w.SetHead()
+		}
+		if req.ExpectsContinue() {
+			// the client holds the body back until it gets a 100, which goes out when the handler first reads it
+			// a handler that answers without reading (ex. 417 or 413) never sends it
+			w.SetExpectContinue()
+			req.Body = &continueBody{ReadCloser: req.Body, w: w}
+		}
+		Chain(s.handler, s.middlewares...)(w, req)
+		if err := req.BodyError(); err != nil && !w.Committed() {
+			// the client's body was broken (ex. over Limits.MaxBodySize or bad chunk framing) and nothing is on the wire yet
+			// so answer that with its status instead of whatever the handler made of it
+			s.writeReadError(conn, err)
+			return
+		}
+		// sends whatever the handler left buffered, or an empty 200 if it never wrote anything
+		if err := w.Finish(); err != nil {
+			s.logError(fmt.Errorf("error writing response: %w", err))
+			return
+		}
+		if w.WillClose() {
+			return
+		}
+		// whatever body the handler didn't read is still on the connection in front of the next request
+		if err := req.Body.Close(); err != nil {
+			return
+		}
+		// if the next request is already buffered the client is mid conversation so we stay active
+		if rr.Buffered() == 0 && !s.trackConn(conn, stateIdle) {
+			return // shutting down
+		}
 	}
-	conn.Close()
 }
 
 // response := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nHello World!"
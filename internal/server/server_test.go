@@ -0,0 +1,611 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sina.http/internal/headers"
+	"sina.http/internal/request"
+	"sina.http/internal/response"
+)
+
+// runs s.handle on one end of an in-memory pipe, writes raw to the other end and returns everything the server sent back
+func roundTrip(t *testing.T, s *Server, raw string) string {
+	client, srvConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.handle(srvConn)
+		close(done)
+	}()
+	go client.Write([]byte(raw))
+	out, err := io.ReadAll(client)
+	require.NoError(t, err)
+	<-done
+	return string(out)
+}
+
+func TestHandlerGetsParsedRequest(t *testing.T) {
+	var target string
+	s := New(func(w *response.Writer, req *request.Request) {
+		target = req.RequestLine.RequestTarget
+		body := []byte("hi")
+		w.WriteStatusLine(200)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	})
+	out := roundTrip(t, s, "GET /coffee HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "/coffee", target)
+	assert.Contains(t, out, "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, out, "\r\n\r\nhi")
+}
+
+func TestBadRequestNeverReachesHandler(t *testing.T) {
+	called := false
+	s := New(func(w *response.Writer, req *request.Request) {
+		called = true
+	})
+	out := roundTrip(t, s, "GET /coffee HTTP-1.1\r\n\r\n")
+	assert.False(t, called)
+	assert.Contains(t, out, "HTTP/1.1 400 Bad Request\r\n")
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	var calls []string
+	tag := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w *response.Writer, req *request.Request) {
+				calls = append(calls, name+" before")
+				next(w, req)
+				calls = append(calls, name+" after")
+			}
+		}
+	}
+	s := New(func(w *response.Writer, req *request.Request) {
+		calls = append(calls, "handler")
+		w.WriteText(200, "ok")
+	})
+	s.Use(tag("outer"), tag("inner"))
+	roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, []string{"outer before", "inner before", "handler", "inner after", "outer after"}, calls)
+}
+
+func TestShutdownWaitsForActiveConnections(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := New(func(w *response.Writer, req *request.Request) {
+		close(started)
+		<-release
+		w.WriteText(200, "finished")
+	})
+	require.NoError(t, s.Listen(0))
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+
+	shutdownErr := make(chan error)
+	go func() { shutdownErr <- s.Shutdown(context.Background()) }()
+
+	// Test: shutdown blocks while the handler is still running
+	select {
+	case <-shutdownErr:
+		t.Fatal("Shutdown returned before the active request finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Test: new connections are refused once shutdown starts
+	_, err = net.Dial("tcp", s.Addr().String())
+	assert.Error(t, err)
+
+	close(release)
+	require.NoError(t, <-shutdownErr)
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "finished")
+}
+
+func TestShutdownForceClosesAfterDeadline(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	s := New(func(w *response.Writer, req *request.Request) {
+		close(started)
+		<-release
+	})
+	require.NoError(t, s.Listen(0))
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+
+	// the server side got closed out from under the client
+	_, err = io.ReadAll(conn)
+	assert.NoError(t, err)
+}
+
+type temporaryErr struct{}
+
+func (temporaryErr) Error() string   { return "too many open files" }
+func (temporaryErr) Temporary() bool { return true }
+
+// fakeListener hands out the queued errors from Accept one at a time, then acts like a closed listener
+type fakeListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	if len(l.errs) == 0 {
+		return nil, net.ErrClosed
+	}
+	err := l.errs[0]
+	l.errs = l.errs[1:]
+	return nil, err
+}
+
+func TestListenRetriesTemporaryErrors(t *testing.T) {
+	var logged []error
+	s := New(nil)
+	s.ErrorLog = func(err error) { logged = append(logged, err) }
+	s.listener = &fakeListener{errs: []error{temporaryErr{}, temporaryErr{}}}
+
+	// returns once the listener reports it's closed, without treating that as an error
+	s.listen()
+	require.Len(t, logged, 2)
+	assert.ErrorIs(t, logged[0], temporaryErr{})
+}
+
+func TestListenStopsOnPermanentError(t *testing.T) {
+	var logged []error
+	permanent := errors.New("listener is broken")
+	s := New(nil)
+	s.ErrorLog = func(err error) { logged = append(logged, err) }
+	s.listener = &fakeListener{errs: []error{permanent, temporaryErr{}}}
+
+	s.listen()
+	require.Len(t, logged, 1)
+	assert.ErrorIs(t, logged[0], permanent)
+}
+
+func TestKeepAliveServesPipelinedRequestsInOrder(t *testing.T) {
+	s := New(func(w *response.Writer, req *request.Request) {
+		w.WriteText(200, req.RequestLine.RequestTarget)
+	})
+	// both requests arrive in one write, the second one asks to close the connection after it
+	out := roundTrip(t, s, "GET /first HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /second HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	first := strings.Index(out, "/first")
+	second := strings.Index(out, "/second")
+	require.NotEqual(t, -1, first)
+	require.NotEqual(t, -1, second)
+	assert.Less(t, first, second)
+	assert.Equal(t, 2, strings.Count(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, 1, strings.Count(out, "Connection: close\r\n"))
+}
+
+func TestLargeResponseIsChunkedAndKeepsConnection(t *testing.T) {
+	s := New(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(200)
+		w.WriteHeaders(headers.NewHeaders())
+		// too big for the writer to hold back and fill in Content-Length itself
+		w.WriteBody([]byte(strings.Repeat("a", 5000)))
+	})
+	out := roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\nGET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, 2, strings.Count(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, 2, strings.Count(out, "Transfer-Encoding: chunked\r\n"))
+	assert.Equal(t, 2, strings.Count(out, "\r\n0\r\n\r\n"))
+}
+
+func TestReadHeaderTimeoutSends408(t *testing.T) {
+	called := false
+	s := New(func(w *response.Writer, req *request.Request) {
+		called = true
+	})
+	s.ReadHeaderTimeout = 20 * time.Millisecond
+	// headers never finish so the server gives up on us
+	out := roundTrip(t, s, "GET / HTTP/1.1\r\nHost: local")
+	assert.False(t, called)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 408 Request Timeout\r\n"))
+	assert.Contains(t, out, "Connection: close\r\n")
+}
+
+func TestIdleTimeoutClosesKeepAliveConnection(t *testing.T) {
+	s := New(func(w *response.Writer, req *request.Request) {
+		w.WriteText(200, "ok")
+	})
+	s.IdleTimeout = 20 * time.Millisecond
+	s.ReadTimeout = time.Minute
+
+	// the connection stays open after the response until the idle timeout hits, then closes without another response
+	start := time.Now()
+	out := roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Less(t, time.Since(start), 10*time.Second)
+	assert.Equal(t, 1, strings.Count(out, "HTTP/1.1 "))
+	assert.NotContains(t, out, "408")
+}
+
+func TestParseErrorsMapToStatusCodes(t *testing.T) {
+	s := New(func(w *response.Writer, req *request.Request) {
+		t.Error("handler shouldn't be called for a malformed request")
+	})
+	out := roundTrip(t, s, "GET / HTTP/2.0\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 505 HTTP Version Not Supported\r\n"))
+	assert.Contains(t, out, "Connection: close\r\n")
+
+	s.Limits = request.Limits{MaxURILength: 100, MaxHeaderBytes: 1000, MaxBodySize: 5}
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nX-Big: "+strings.Repeat("a", 2000)+"\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 431 Request Header Fields Too Large\r\n"))
+
+	out = roundTrip(t, s, "GET /"+strings.Repeat("a", 200)+" HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 414 URI Too Long\r\n"))
+
+	out = roundTrip(t, s, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 6\r\n\r\n123456")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 Content Too Large\r\n"))
+
+	// ambiguous framing is a 400 and the smuggled request behind it never gets read
+	out = roundTrip(t, s, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nGET /admin HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"))
+	assert.Equal(t, 1, strings.Count(out, "HTTP/1.1"))
+
+	// same for a folded Transfer-Encoding an RFC 9112 front end would have read as part of Host
+	out = roundTrip(t, s, "POST / HTTP/1.1\r\nHost: localhost\r\n Transfer-Encoding: chunked\r\n\r\n0\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"))
+	assert.Equal(t, 1, strings.Count(out, "HTTP/1.1"))
+
+	out = roundTrip(t, s, "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: gzip, chunked\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 501 Not Implemented\r\n"))
+
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nBad Header: x\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"))
+	assert.True(t, strings.HasSuffix(out, "Malformed HTTP header\r\n"))
+}
+
+func TestHandlerStreamsBodyAndUnreadBodyIsSkipped(t *testing.T) {
+	s := New(func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/echo" {
+			body, _ := io.ReadAll(req.Body)
+			w.WriteText(200, "got "+string(body))
+			return
+		}
+		// never touches the body
+		w.WriteText(200, "ignored")
+	})
+	out := roundTrip(t, s, "POST /ignore HTTP/1.1\r\nHost: localhost\r\nContent-Length: 6\r\n\r\nfoobar"+
+		"POST /echo HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\nConnection: close\r\n\r\nbaz")
+	assert.Contains(t, out, "ignored")
+	assert.True(t, strings.HasSuffix(out, "got baz"))
+}
+
+func TestDateAndServerHeaders(t *testing.T) {
+	s := New(func(w *response.Writer, req *request.Request) {
+		w.WriteText(200, "hi")
+	})
+	// Test: every response gets an IMF-fixdate Date and the default Server header
+	out := roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.Regexp(t, `\r\nDate: (Mon|Tue|Wed|Thu|Fri|Sat|Sun), \d{2} [A-Z][a-z]{2} \d{4} \d{2}:\d{2}:\d{2} GMT\r\n`, out)
+	assert.Contains(t, out, "Server: "+DefaultServerHeader+"\r\n")
+
+	// Test: error responses get them too
+	out = roundTrip(t, s, "GARBAGE\r\n\r\n")
+	assert.Contains(t, out, "\r\nDate: ")
+
+	// Test: empty ServerHeader leaves it out, and a handler's own Date wins
+	s = New(func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Set("Date", "Sun, 06 Nov 1994 08:49:37 GMT")
+		w.WriteStatusLine(200)
+		w.WriteHeaders(h)
+	})
+	s.ServerHeader = ""
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.NotContains(t, out, "Server:")
+	assert.Equal(t, 1, strings.Count(out, "Date:"))
+	assert.Contains(t, out, "Date: Sun, 06 Nov 1994 08:49:37 GMT\r\n")
+}
+
+func TestDateCache(t *testing.T) {
+	var c dateCache
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Equal(t, "Tue, 02 Jan 2024 03:04:05 GMT", c.get(now))
+	// Test: same second reuses the cached value, the next one gets a new one
+	first := c.cur.Load()
+	c.get(now.Add(500 * time.Millisecond))
+	assert.Same(t, first, c.cur.Load())
+	assert.Equal(t, "Tue, 02 Jan 2024 03:04:06 GMT", c.get(now.Add(time.Second)))
+}
+
+func TestRedirectCanonicalPath(t *testing.T) {
+	var path string
+	s := New(func(w *response.Writer, req *request.Request) {
+		path = req.URL.Path
+		w.WriteText(200, "ok")
+	})
+	s.Use(RedirectCanonicalPath)
+
+	// Test: non-canonical GET gets a 301 to the normalized path with the query kept
+	out := roundTrip(t, s, "GET /a//b/./../c?x=1 HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 301 Moved Permanently\r\n"))
+	assert.Contains(t, out, "Location: /a/c?x=1\r\n")
+	assert.Equal(t, "", path)
+
+	// Test: other methods get a 308
+	out = roundTrip(t, s, "POST /%7Ea HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 308 Permanent Redirect\r\n"))
+	assert.Contains(t, out, "Location: /~a\r\n")
+
+	// Test: canonical paths go straight through
+	out = roundTrip(t, s, "GET /a/c HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "ok"))
+	assert.Equal(t, "/a/c", path)
+
+	// Test: encoded traversal is a 400 and never reaches the handler
+	path = ""
+	out = roundTrip(t, s, "GET /static/..%2f..%2fetc/passwd HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"))
+	assert.Equal(t, "", path)
+}
+
+func TestHTTP10Connections(t *testing.T) {
+	s := New(func(w *response.Writer, req *request.Request) {
+		w.WriteText(200, req.RequestLine.RequestTarget)
+	})
+	// Test: 1.0 gets a 1.0 response and the connection closes after it even with more requests waiting
+	out := roundTrip(t, s, "GET /one HTTP/1.0\r\n\r\nGET /two HTTP/1.0\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.0 200 OK\r\n"))
+	assert.Contains(t, out, "Connection: close\r\n")
+	assert.NotContains(t, out, "/two")
+
+	// Test: keep-alive keeps it open for the next one
+	out = roundTrip(t, s, "GET /one HTTP/1.0\r\nConnection: keep-alive\r\n\r\nGET /two HTTP/1.0\r\n\r\n")
+	assert.Equal(t, 2, strings.Count(out, "HTTP/1.0 200 OK\r\n"))
+	assert.Contains(t, out, "Connection: keep-alive\r\n")
+	assert.True(t, strings.HasSuffix(out, "/two"))
+
+	// Test: text HTTP/2.0 is a 505
+	out = roundTrip(t, s, "GET / HTTP/2.0\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 505 HTTP Version Not Supported\r\n"))
+}
+
+func TestExpectContinue(t *testing.T) {
+	s := New(func(w *response.Writer, req *request.Request) {
+		if req.URL.Path == "/reject" {
+			w.WriteText(413, "too big\r\n")
+			return
+		}
+		body, _ := req.BufferBody()
+		w.WriteText(200, string(body))
+	})
+
+	// Test: headers only, the 100 comes once the handler reads, then the client sends the body
+	client, srvConn := net.Pipe()
+	go s.handle(srvConn)
+	go client.Write([]byte("POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\nConnection: close\r\n\r\n"))
+	buf := make([]byte, len("HTTP/1.1 100 Continue\r\n\r\n"))
+	_, err := io.ReadFull(client, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", string(buf))
+	go client.Write([]byte("hello"))
+	out, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(string(out), "hello"))
+
+	// Test: status and headers set before reading are still held back so the 100 goes out ahead of them
+	s201 := New(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(201)
+		w.WriteHeaders(headers.NewHeaders())
+		body, err := req.BufferBody()
+		require.NoError(t, err)
+		w.WriteBody(body)
+	})
+	s201.ReadTimeout = time.Second
+	client, srvConn = net.Pipe()
+	go s201.handle(srvConn)
+	go client.Write([]byte("PUT /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\nConnection: close\r\n\r\n"))
+	_, err = io.ReadFull(client, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", string(buf))
+	go client.Write([]byte("hello"))
+	out, err = io.ReadAll(client)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 201 Created\r\n"))
+	assert.True(t, strings.HasSuffix(string(out), "hello"))
+
+	// Test: handler answering without reading means no 100 and the connection closes
+	out2 := roundTrip(t, s, "POST /reject HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5000\r\nExpect: 100-continue\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out2, "HTTP/1.1 413 Content Too Large\r\n"))
+	assert.NotContains(t, out2, "100 Continue")
+	assert.Contains(t, out2, "Connection: close\r\n")
+
+	// Test: anything but 100-continue is a 417
+	out2 = roundTrip(t, s, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\nExpect: something-else\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out2, "HTTP/1.1 417 Expectation Failed\r\n"))
+
+	// Test: 1.0 clients don't get a 100
+	out2 = roundTrip(t, s, "POST / HTTP/1.0\r\nContent-Length: 2\r\nExpect: 100-continue\r\n\r\nhi")
+	assert.True(t, strings.HasPrefix(out2, "HTTP/1.0 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(out2, "hi"))
+}
+
+func TestHeadSuppressesBody(t *testing.T) {
+	s := New(func(w *response.Writer, req *request.Request) {
+		w.WriteText(200, "hello world")
+	})
+	// Test: HEAD gets GET's headers without the body, and the next request on the connection still works
+	out := roundTrip(t, s, "HEAD / HTTP/1.1\r\nHost: localhost\r\n\r\nGET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, 2, strings.Count(out, "Content-Length: 11\r\n"))
+	assert.Equal(t, 1, strings.Count(out, "hello world"))
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello world"))
+}
+
+func TestPanicRecovery(t *testing.T) {
+	var logged []error
+	s := New(func(w *response.Writer, req *request.Request) {
+		switch req.URL.Path {
+		case "/early":
+			panic("boom")
+		case "/late":
+			w.WriteStatusLine(200)
+			w.WriteHeaders(headers.NewHeaders())
+			w.WriteBody([]byte("partial"))
+			w.Flush()
+			panic("boom after flush")
+		}
+		w.WriteText(200, "fine")
+	})
+	s.ErrorLog = func(err error) { logged = append(logged, err) }
+
+	// Test: panic before anything was sent is a 500 and the connection closes, with the stack logged
+	out := roundTrip(t, s, "GET /early HTTP/1.1\r\nHost: localhost\r\n\r\nGET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 500 Internal Server Error\r\n"))
+	assert.Contains(t, out, "Connection: close\r\n")
+	assert.NotContains(t, out, "fine")
+	require.Len(t, logged, 1)
+	assert.Contains(t, logged[0].Error(), "boom")
+	assert.Contains(t, logged[0].Error(), "goroutine")
+
+	// Test: panic after the headers went out just cuts the response off, no second status line
+	out = roundTrip(t, s, "GET /late HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, 1, strings.Count(out, "HTTP/1.1"))
+	assert.True(t, strings.HasSuffix(out, "7\r\npartial\r\n"), "no terminating chunk so the client can tell it was cut short")
+	require.Len(t, logged, 2)
+
+	// Test: the server keeps serving other connections
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "fine"))
+}
+
+func TestShutdownWaitsForRequestAlreadyArriving(t *testing.T) {
+	var logged []error
+	s := New(func(w *response.Writer, req *request.Request) {
+		w.WriteText(200, req.URL.Path)
+	})
+	s.ErrorLog = func(err error) { logged = append(logged, err) }
+	require.NoError(t, s.Listen(0))
+
+	// Test: a connection that never sent anything doesn't hold Shutdown up
+	silent, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer silent.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /first HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	first := "/first"
+	buf := make([]byte, 0, 512)
+	for !strings.HasSuffix(string(buf), first) {
+		tmp := make([]byte, 512)
+		n, err := conn.Read(tmp)
+		require.NoError(t, err)
+		buf = append(buf, tmp[:n]...)
+	}
+
+	// Test: half of the next request is in when Shutdown starts, it still gets answered
+	_, err = conn.Write([]byte("GET /second HTTP/1.1\r\nHo"))
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	shutdownErr := make(chan error)
+	go func() { shutdownErr <- s.Shutdown(context.Background()) }()
+	select {
+	case <-shutdownErr:
+		t.Fatal("Shutdown returned while a request was arriving")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, err = conn.Write([]byte("st: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, string(out), "Connection: close\r\n")
+	assert.True(t, strings.HasSuffix(string(out), "/second"))
+
+	select {
+	case err := <-shutdownErr:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown didn't return once the last request was answered")
+	}
+	assert.Empty(t, logged)
+
+	// the silent connection got closed as idle
+	silent.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = silent.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestBrokenBodyGetsErrorStatus(t *testing.T) {
+	s := New(func(w *response.Writer, req *request.Request) {
+		io.ReadAll(req.Body)
+	})
+	s.Limits = request.Limits{MaxBodySize: 3}
+
+	// Test: chunked body going over MaxBodySize is a 413 even though the handler wrote nothing
+	out := roundTrip(t, s, "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 Content Too Large\r\n"))
+	assert.Contains(t, out, "Connection: close\r\n")
+
+	// Test: bad chunk framing is a 400
+	out = roundTrip(t, s, "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nhi\r\n0\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"))
+	assert.Contains(t, out, "Connection: close\r\n")
+}
+
+func TestResponseCantSpillIntoNextOne(t *testing.T) {
+	s := New(func(w *response.Writer, req *request.Request) {
+		switch req.URL.Path {
+		case "/long":
+			w.WriteStatusLine(200)
+			w.WriteHeaders(response.GetDefaultHeaders(2))
+			w.WriteBody([]byte("hiHTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nevil"))
+		case "/short":
+			w.WriteStatusLine(200)
+			w.WriteHeaders(response.GetDefaultHeaders(5))
+			w.WriteBody([]byte("hi"))
+		case "/nocontent":
+			w.WriteStatusLine(204)
+			w.WriteHeaders(headers.NewHeaders())
+			w.WriteBody([]byte("oops"))
+		default:
+			w.WriteText(200, "second")
+		}
+	})
+	next := "GET /second HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"
+
+	// Test: body past the Content-Length is cut off so the pipelined request gets its own response
+	out := roundTrip(t, s, "GET /long HTTP/1.1\r\nHost: localhost\r\n\r\n"+next)
+	assert.NotContains(t, out, "evil")
+	assert.Equal(t, 2, strings.Count(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "\r\n\r\nhiHTTP/1.1 200 OK\r\n")
+	assert.True(t, strings.HasSuffix(out, "second"))
+
+	// Test: body short of the Content-Length closes the connection instead of serving the next request
+	out = roundTrip(t, s, "GET /short HTTP/1.1\r\nHost: localhost\r\n\r\n"+next)
+	assert.Equal(t, 1, strings.Count(out, "HTTP/1.1 200 OK\r\n"))
+	assert.NotContains(t, out, "second")
+
+	// Test: a 204 body never goes out
+	out = roundTrip(t, s, "GET /nocontent HTTP/1.1\r\nHost: localhost\r\n\r\n"+next)
+	assert.NotContains(t, out, "oops")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 204 No Content\r\n"))
+	assert.True(t, strings.HasSuffix(out, "second"))
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"sina.http/internal/request"
+	"sina.http/internal/response"
+)
+
+// VirtualHosts picks a handler by the host a request is for so one server can serve several sites
+// it has the Handler signature (ServeRequest) so it can be passed to New like any other handler
+//
+//	hosts := server.NewVirtualHosts()
+//	hosts.Handle("example.test", siteRouter.ServeRequest)
+//	hosts.Handle("*.example.test", tenantRouter.ServeRequest)
+//	hosts.Default(fallback)
+type VirtualHosts struct {
+	exact     map[string]Handler
+	wildcards []wildcardHost
+	fallback  Handler
+}
+
+// *.example.test is stored as suffix .example.test
+type wildcardHost struct {
+	suffix  string
+	handler Handler
+}
+
+func NewVirtualHosts() *VirtualHosts {
+	return &VirtualHosts{exact: map[string]Handler{}}
+}
+
+// Handle serves requests for host with handler, host is matched without its port and ignoring case
+// a leading *. matches any subdomain (at any depth) but not the domain itself, ex. *.example.test matches a.example.test and a.b.example.test
+// panics on an empty host or one that's already registered, same as a bad route pattern
+func (vh *VirtualHosts) Handle(host string, handler Handler) {
+	host = normalizeHost(host)
+	if suffix, ok := strings.CutPrefix(host, "*"); ok {
+		if !strings.HasPrefix(suffix, ".") || len(suffix) == 1 || strings.Contains(suffix, "*") {
+			panic(fmt.Sprintf("virtual host %q: wildcard has to look like *.example.test", host))
+		}
+		for _, w := range vh.wildcards {
+			if w.suffix == suffix {
+				panic(fmt.Sprintf("virtual host %q registered twice", host))
+			}
+		}
+		vh.wildcards = append(vh.wildcards, wildcardHost{suffix: suffix, handler: handler})
+		return
+	}
+	if host == "" || strings.Contains(host, "*") {
+		panic(fmt.Sprintf("virtual host %q: has to be a host name or *.domain", host))
+	}
+	if _, ok := vh.exact[host]; ok {
+		panic(fmt.Sprintf("virtual host %q registered twice", host))
+	}
+	vh.exact[host] = handler
+}
+
+// Default serves requests whose host doesn't match anything else, including 1.0 requests without a Host header
+func (vh *VirtualHosts) Default(handler Handler) {
+	vh.fallback = handler
+}
+
+// ServeRequest dispatches to the handler for req's host
+// exact hosts win over wildcards and longer wildcards win over shorter ones, then the default
+// with no default an unknown host gets 421 Misdirected Request since this server doesn't serve that site
+func (vh *VirtualHosts) ServeRequest(w *response.Writer, req *request.Request) {
+	if h := vh.match(normalizeHost(req.Host())); h != nil {
+		h(w, req)
+		return
+	}
+	w.WriteText(response.StatusCodeMisdirectedRequest, "Misdirected Request\r\n")
+}
+
+func (vh *VirtualHosts) match(host string) Handler {
+	if h, ok := vh.exact[host]; ok {
+		return h
+	}
+	var best *wildcardHost
+	for i, w := range vh.wildcards {
+		if strings.HasSuffix(host, w.suffix) && len(host) > len(w.suffix) && (best == nil || len(w.suffix) > len(best.suffix)) {
+			best = &vh.wildcards[i]
+		}
+	}
+	if best != nil {
+		return best.handler
+	}
+	return vh.fallback
+}
+
+// lowercases host and drops the port and any trailing dot, ex. API.Example.test.:8080 -> api.example.test
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return host
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sina.http/internal/request"
+	"sina.http/internal/response"
+)
+
+func TestVirtualHosts(t *testing.T) {
+	text := func(msg string) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			w.WriteText(200, msg)
+		}
+	}
+	hosts := NewVirtualHosts()
+	hosts.Handle("example.test", text("main"))
+	hosts.Handle("*.example.test", text("tenant"))
+	hosts.Handle("*.api.example.test", text("api"))
+	hosts.Handle("static.example.test", text("static"))
+	s := New(hosts.ServeRequest)
+
+	get := func(host string) string {
+		return roundTrip(t, s, "GET / HTTP/1.1\r\nHost: "+host+"\r\nConnection: close\r\n\r\n")
+	}
+
+	// Test: exact match ignoring case, port and a trailing dot
+	assert.True(t, strings.HasSuffix(get("example.test"), "main"))
+	assert.True(t, strings.HasSuffix(get("EXAMPLE.test.:8080"), "main"))
+
+	// Test: exact beats wildcard, longest wildcard wins, wildcards match any depth but not the bare domain
+	assert.True(t, strings.HasSuffix(get("static.example.test"), "static"))
+	assert.True(t, strings.HasSuffix(get("acme.example.test"), "tenant"))
+	assert.True(t, strings.HasSuffix(get("a.b.example.test"), "tenant"))
+	assert.True(t, strings.HasSuffix(get("v1.api.example.test"), "api"))
+	assert.True(t, strings.HasSuffix(get("api.example.test"), "tenant"))
+	assert.False(t, strings.HasSuffix(get("badexample.test"), "tenant"))
+
+	// Test: unknown host without a default
+	assert.True(t, strings.HasPrefix(get("other.test"), "HTTP/1.1 421 Misdirected Request\r\n"))
+
+	// Test: default catches unknown hosts and 1.0 requests with no Host at all
+	hosts.Default(text("default"))
+	assert.True(t, strings.HasSuffix(get("other.test"), "default"))
+	out := roundTrip(t, s, "GET / HTTP/1.0\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "default"))
+
+	// Test: an absolute-form target's host wins over the Host header
+	out = roundTrip(t, s, "GET http://static.example.test/ HTTP/1.1\r\nHost: example.test\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "static"))
+
+	// Test: bad registrations panic
+	assert.Panics(t, func() { hosts.Handle("example.test", text("")) })
+	assert.Panics(t, func() { hosts.Handle("*example.test", text("")) })
+	assert.Panics(t, func() { hosts.Handle("a.*.test", text("")) })
+	assert.Panics(t, func() { hosts.Handle("", text("")) })
+}
+
+func TestHostHeaderEnforced(t *testing.T) {
+	s := New(func(w *response.Writer, req *request.Request) {
+		t.Error("handler shouldn't be called without a valid Host")
+	})
+	// Test: missing, duplicate and malformed Host are all 400s
+	for _, hdrs := range []string{"", "Host: a.test\r\nHost: b.test\r\n", "Host: a.test, b.test\r\n", "Host: user@a.test\r\n", "Host: a.test:80x\r\n"} {
+		out := roundTrip(t, s, "GET / HTTP/1.1\r\n"+hdrs+"\r\n")
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"), hdrs)
+	}
+}